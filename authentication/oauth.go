@@ -3,6 +3,7 @@ package authentication
 import (
 	"fmt"
 	"net/http"
+	"nmmpocket/lib"
 	"os"
 	"strings"
 	"time"
@@ -163,65 +164,59 @@ func handleLoginGetRoute(e *core.RequestEvent) error {
 	return e.HTML(http.StatusOK, html)
 }
 
-// handleLoginPostRoute handles the login form submission
-func handleLoginPostRoute(e *core.RequestEvent) error {
+// loadOAuthSession returns the OAuth session of the oauth_session cookie
+func loadOAuthSession(e *core.RequestEvent) (*core.Record, *OAuthSession, error) {
 	// Get session ID from cookie
 	sessionCookie, err := e.Request.Cookie("oauth_session")
 	if err != nil {
-		return apis.NewBadRequestError("Invalid session", nil)
+		return nil, nil, apis.NewBadRequestError("Invalid session", nil)
 	}
 
 	// Get session record
 	collection, err := e.App.FindCollectionByNameOrId("oauth_sessions")
 	if err != nil {
-		return apis.NewInternalServerError("Failed to access sessions collection", err)
+		return nil, nil, apis.NewInternalServerError("Failed to access sessions collection", err)
 	}
 
 	record, err := e.App.FindRecordById(collection, sessionCookie.Value)
 	if err != nil {
-		return apis.NewBadRequestError("Session expired", nil)
+		return nil, nil, apis.NewBadRequestError("Session expired", nil)
 	}
 
 	session := newOAuthSessionFromRecord(record)
 	if time.Now().After(session.ExpiresAt) {
 		// Clean up expired session
 		e.App.Delete(record)
-		return apis.NewBadRequestError("Session expired", nil)
+		return nil, nil, apis.NewBadRequestError("Session expired", nil)
 	}
+	return record, session, nil
+}
 
-	// Parse login form data
-	username := e.Request.FormValue("username")
-	password := e.Request.FormValue("password")
-
+// oauthAuthCollection returns the auth collection users of the session's client log in to
+func oauthAuthCollection(e *core.RequestEvent, session *OAuthSession) (*core.Collection, error) {
 	// Get OAuth app to determine collection
 	oauthApp, err := e.App.FindRecordById("oauth_apps", session.ClientID)
 	if err != nil {
-		return apis.NewBadRequestError("Invalid client", nil)
+		return nil, apis.NewBadRequestError("Invalid client", nil)
 	}
 
 	// Get the collection from oauth_apps
 	collectionString := oauthApp.GetString("collection")
 	if collectionString == "" {
-		return apis.NewBadRequestError("Invalid client configuration", nil)
+		return nil, apis.NewBadRequestError("Invalid client configuration", nil)
 	}
 
 	// Get the auth collection
 	authCollection, err := e.App.FindCollectionByNameOrId(collectionString)
 	if err != nil {
-		return apis.NewBadRequestError("Invalid client configuration", nil)
-	}
-
-	// Authenticate user using the specified collection
-	authRecord, err := e.App.FindAuthRecordByEmail(authCollection, username)
-	if err != nil {
-		return apis.NewBadRequestError("Invalid credentials", nil)
-	}
-
-	// Verify password
-	if !authRecord.ValidatePassword(password) {
-		return apis.NewBadRequestError("Invalid credentials", nil)
+		return nil, apis.NewBadRequestError("Invalid client configuration", nil)
 	}
+	return authCollection, nil
+}
 
+// issueAuthCode stores a new authorization code for authRecord on the session
+// and returns the client redirect URL carrying it
+func issueAuthCode(e *core.RequestEvent, record *core.Record, session *OAuthSession, authRecord *core.Record) (string, error) {
 	// Generate authorization code
 	authCode := security.RandomString(32)
 
@@ -234,7 +229,7 @@ func handleLoginPostRoute(e *core.RequestEvent) error {
 	record.Set("user_id", authRecord.Id)
 
 	if err := e.App.Save(record); err != nil {
-		return apis.NewInternalServerError("Failed to update session", err)
+		return "", apis.NewInternalServerError("Failed to update session", err)
 	}
 
 	// Redirect back to client with authorization code
@@ -243,7 +238,52 @@ func handleLoginPostRoute(e *core.RequestEvent) error {
 		redirectURL += "?"
 	}
 	redirectURL += "code=" + authCode + "&state=" + session.State
+	return redirectURL, nil
+}
+
+// handleLoginPostRoute handles the login form submission
+func handleLoginPostRoute(e *core.RequestEvent) error {
+	record, session, err := loadOAuthSession(e)
+	if err != nil {
+		return err
+	}
 
+	// Parse login form data
+	username := e.Request.FormValue("username")
+	password := e.Request.FormValue("password")
+
+	authCollection, err := oauthAuthCollection(e, session)
+	if err != nil {
+		return err
+	}
+
+	event := lib.AuthEvent{
+		Event:      "oauth_login",
+		Method:     lib.AuthMethodPassword,
+		Collection: authCollection.Name,
+		Email:      username,
+		Details:    map[string]any{"client_id": session.ClientID},
+	}
+
+	// Authenticate user using the specified collection
+	authRecord, err := e.App.FindAuthRecordByEmail(authCollection, username)
+	if err != nil {
+		lib.RecordAuthFailure(e.App, e, event, fmt.Errorf("unknown user"))
+		return apis.NewBadRequestError("Invalid credentials", nil)
+	}
+	event.RecordID = authRecord.Id
+
+	// Verify password
+	if !authRecord.ValidatePassword(password) {
+		lib.RecordAuthFailure(e.App, e, event, fmt.Errorf("wrong password"))
+		return apis.NewBadRequestError("Invalid credentials", nil)
+	}
+
+	redirectURL, err := issueAuthCode(e, record, session, authRecord)
+	if err != nil {
+		return err
+	}
+	lib.RecordAuthEvent(e.App, e, event)
 	return e.Redirect(http.StatusFound, redirectURL)
 }
 
@@ -325,20 +365,30 @@ func handleTokenRoute(e *core.RequestEvent) error {
 		return apis.NewBadRequestError("Invalid grant_type. Only 'authorization_code' is supported", nil)
 	}
 
+	event := lib.AuthEvent{
+		Event:   "oauth_token",
+		Method:  lib.AuthMethodOAuth,
+		Details: map[string]any{"client_id": clientID},
+	}
+
 	// Validate client credentials
 	oauthApp, err := e.App.FindRecordById("oauth_apps", clientID)
 	if err != nil {
+		lib.RecordAuthFailure(e.App, e, event, fmt.Errorf("invalid client_id"))
 		return apis.NewForbiddenError("Invalid client_id", nil)
 	}
 
 	if oauthApp.GetString("client_secret") != clientSecret {
+		lib.RecordAuthFailure(e.App, e, event, fmt.Errorf("invalid client_secret"))
 		return apis.NewForbiddenError("Invalid client_secret", nil)
 	}
 
 	allowedURI := oauthApp.GetString("redirect_uri")
 	if !validateRedirectURI(allowedURI, redirectURI) {
+		lib.RecordAuthFailure(e.App, e, event, fmt.Errorf("invalid redirect_uri"))
 		return apis.NewForbiddenError("Invalid redirect_uri", nil)
 	}
+	event.Collection = oauthApp.GetString("collection")
 
 	// Find session with matching auth code
 	collection, err := e.App.FindCollectionByNameOrId("oauth_sessions")
@@ -359,6 +409,7 @@ func handleTokenRoute(e *core.RequestEvent) error {
 	}
 
 	if len(records) == 0 {
+		lib.RecordAuthFailure(e.App, e, event, fmt.Errorf("invalid authorization code"))
 		return apis.NewBadRequestError("Invalid authorization code", nil)
 	}
 
@@ -396,6 +447,10 @@ func handleTokenRoute(e *core.RequestEvent) error {
 		}
 	}
 
+	event.RecordID = user.Id
+	event.Email = user.Email()
+	lib.RecordAuthEvent(e.App, e, event)
+
 	// Return token response
 	return e.JSON(http.StatusOK, response)
 }
@@ -487,6 +542,14 @@ func handleExternalAppExchangeRoute(e *core.RequestEvent) error {
 	if err := e.App.Save(record); err != nil {
 		return apis.NewInternalServerError("Failed to update session", err)
 	}
+	lib.RecordAuthEvent(e.App, e, lib.AuthEvent{
+		Event:      "oauth_exchange",
+		Method:     lib.AuthMethodToken,
+		Collection: authRecord.Collection().Name,
+		RecordID:   authRecord.Id,
+		Email:      authRecord.Email(),
+		Details:    map[string]any{"client_id": oauthApp.Id, "app_name": oauthApp.GetString("name")},
+	})
 
 	// Redirect back to client with authorization code
 	redirectURL := session.RedirectURI
@@ -0,0 +1,105 @@
+package authentication
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"nmmpocket/lib"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+// RegisterOAuthPasskeyRoutes registers the passkey login of the OAuth login
+// page. The WebAuthn ceremony is kept on the oauth_sessions record of the
+// oauth_session cookie, so an assertion can only complete the authorization
+// it was started for.
+func RegisterOAuthPasskeyRoutes(router *router.Router[*core.RequestEvent], app *pocketbase.PocketBase, webAuthn *webauthn.WebAuthn, sessions lib.WebAuthnSessionStore) {
+	router.POST("/oauth/login/passkey", func(e *core.RequestEvent) error {
+		record, session, err := loadOAuthSession(e)
+		if err != nil {
+			return err
+		}
+		authCollection, err := oauthAuthCollection(e, session)
+		if err != nil {
+			return err
+		}
+
+		policy := lib.LoadWebAuthnPolicy(app, authCollection.Name)
+		options, sessionData, err := webAuthn.BeginDiscoverableLogin(policy.LoginOptions()...)
+		if err != nil {
+			return apis.NewBadRequestError("Failed to start login flow", err)
+		}
+		ceremonyID, err := sessions.Save(lib.CeremonyLogin, sessionData)
+		if err != nil {
+			return apis.NewInternalServerError("Failed to store session data", err)
+		}
+
+		record.Set("webauthn_ceremony", ceremonyID)
+		if err := e.App.Save(record); err != nil {
+			return apis.NewInternalServerError("Failed to update session", err)
+		}
+		return e.JSON(http.StatusOK, options)
+	})
+
+	router.POST("/oauth/login/passkey/finish", func(e *core.RequestEvent) error {
+		record, session, err := loadOAuthSession(e)
+		if err != nil {
+			return err
+		}
+		authCollection, err := oauthAuthCollection(e, session)
+		if err != nil {
+			return err
+		}
+
+		// the ceremony can only be used once
+		sessionData, err := sessions.Consume(lib.CeremonyLogin, record.GetString("webauthn_ceremony"))
+		if err != nil {
+			return apis.NewBadRequestError("Invalid session data", err)
+		}
+		record.Set("webauthn_ceremony", "")
+
+		event := lib.AuthEvent{
+			Event:      "oauth_login",
+			Method:     lib.AuthMethodPasskey,
+			Collection: authCollection.Name,
+			Details:    map[string]any{"client_id": session.ClientID},
+		}
+		io.ReadAll(e.Request.Body)
+		found, credential, err := webAuthn.FinishPasskeyLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			// only accounts of the client's collection can log in
+			idB64 := base64.StdEncoding.EncodeToString(userHandle)
+			authRecord, err := app.FindFirstRecordByData(authCollection.Name, lib.WEBAUTHN_ID_B64_FIELDNAME, idB64)
+			if err != nil {
+				return nil, fmt.Errorf("no user with this passkey")
+			}
+			return lib.FindUser(app, authRecord.GetString("email"), authCollection.Name)
+		}, *sessionData, e.Request)
+		if err != nil {
+			lib.RecordAuthFailure(app, e, event, err)
+			return apis.NewBadRequestError("Invalid credentials", err)
+		}
+		user := found.(*lib.User)
+		if err := lib.CompleteWebAuthnLogin(app, e, user, authCollection.Name, credential); err != nil {
+			return err
+		}
+
+		authRecord, err := e.App.FindRecordById(authCollection, user.Id)
+		if err != nil {
+			return apis.NewBadRequestError("Invalid credentials", nil)
+		}
+		redirectURL, err := issueAuthCode(e, record, session, authRecord)
+		if err != nil {
+			return err
+		}
+		event.RecordID = authRecord.Id
+		event.Email = authRecord.Email()
+		lib.RecordAuthEvent(app, e, event)
+		// the login page follows the redirect itself
+		return e.JSON(http.StatusOK, map[string]string{"redirect_url": redirectURL})
+	})
+}
@@ -1,6 +1,7 @@
 package authentication
 
 import (
+	"nmmpocket/lib"
 	"os"
 	"time"
 
@@ -47,6 +48,17 @@ func generateMemberJWT(userID, first_name, last_name, email, expiration, group s
 	return token.SignedString(sharedSecret)
 }
 
+// recordTokenIssued audits a shared-secret JWT handed to the logged in account
+func recordTokenIssued(e *core.RequestEvent, event string) {
+	lib.RecordAuthEvent(e.App, e, lib.AuthEvent{
+		Event:      event,
+		Method:     lib.AuthMethodToken,
+		Collection: e.Auth.Collection().Name,
+		RecordID:   e.Auth.Id,
+		Email:      e.Auth.Email(),
+	})
+}
+
 func Routes(router *router.Router[*core.RequestEvent]) {
 	router.GET("/user_token", func(e *core.RequestEvent) error {
 		//get the auth user
@@ -58,6 +70,7 @@ func Routes(router *router.Router[*core.RequestEvent]) {
 		if err != nil {
 			return apis.NewInternalServerError("Failed to generate token.", err)
 		}
+		recordTokenIssued(e, "user_token")
 		return e.JSON(200, map[string]string{"token": token})
 
 	}).Bind(apis.RequireAuth())
@@ -72,6 +85,7 @@ func Routes(router *router.Router[*core.RequestEvent]) {
 		if err != nil {
 			return apis.NewInternalServerError("Failed to generate token.", err)
 		}
+		recordTokenIssued(e, "member_token")
 		return e.JSON(200, map[string]string{"token": token})
 
 	})
@@ -1,11 +1,19 @@
 package email
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"net/mail"
 	"nmmpocket/lib"
+	"os"
+	"strings"
 
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
 )
 
 func RegisterMailer(app *pocketbase.PocketBase) {
@@ -26,19 +34,151 @@ func RegisterMailer(app *pocketbase.PocketBase) {
 			}
 			recipients = append(recipients, recipient)
 		}
-		from := lib.Contact{
-			Email: e.Message.From.Address,
-			Name:  e.Message.From.Name,
+		recipients = lib.FilterRecipients(lib.EmailCategoryTransactional, recipients)
+		if len(recipients) == 0 {
+			fmt.Println("No recipients left after applying the suppression list")
+			return nil
 		}
-		fmt.Printf("Sending email from %s to %d recipients\n", from.Email, len(recipients))
-		// Send email using lib.EmailSender instead of pocketbase mailer
-		err := lib.EmailSenderFrom(from, from, recipients, e.Message.Subject, e.Message.HTML, nil)
+		// Every To address gets its own message version, so copies go on the
+		// first one left only to avoid sending them one per recipient.
+		// lib.EmailSendPayload drops suppressed copies.
+		recipients[0].CC = contactMaps(e.Message.Cc)
+		recipients[0].BCC = contactMaps(e.Message.Bcc)
+
+		payload, err := payloadFromMessage(e.Message)
 		if err != nil {
 			return err
 		}
+		fmt.Printf("Sending email from %s to %d recipients\n", payload.Sender.Email, len(recipients))
+		// Send email using lib.EmailSendPayload instead of pocketbase mailer
+		err = lib.EmailSendPayload(lib.EmailCategoryTransactional, recipients, payload)
+		if err == nil {
+			// Return nil to skip the default mailer
+			return nil
+		}
+		if lib.CurrentEmailProvider().Name() != "brevo" {
+			return err
+		}
 
-		// Return nil to skip the default mailer
-		return nil
+		// Brevo rejected the send, deliver what failed through PocketBase's own
+		// mailer. A retry the outbox queued is cancelled first so nobody gets
+		// it twice; if the outbox already picked it up it is left to finish.
+		var queued *lib.RetryQueuedError
+		if errors.Is(err, lib.ErrOutboxClaimed) ||
+			errors.As(err, &queued) && !lib.CancelOutboxRetry(app, queued.OutboxID, "sent over SMTP instead") {
+			fmt.Printf("Brevo send failed, already being retried: %v\n", err)
+			return nil
+		}
+		fmt.Printf("Brevo send failed, falling back to SMTP: %v\n", err)
+		failed := recipients
+		var partial *lib.PartialSendError
+		if errors.As(err, &partial) {
+			failed = failedRecipients(recipients, partial.FailedEmails())
+		}
+		e.Message.To = nil
+		for _, r := range failed {
+			e.Message.To = append(e.Message.To, mail.Address{Name: r.Name, Address: r.Email})
+		}
+		e.Message.Cc = nil
+		e.Message.Bcc = nil
+		if len(failed) > 0 && failed[0].Email == recipients[0].Email {
+			// the copies haven't been checked against the suppression list yet
+			first := lib.FilterRecipients(lib.EmailCategoryTransactional, failed[:1])
+			if len(first) > 0 {
+				e.Message.Cc = contactAddresses(first[0].CC)
+				e.Message.Bcc = contactAddresses(first[0].BCC)
+			}
+		}
+		return e.Next()
 	})
 
 }
+
+// payloadFromMessage maps a mailer.Message onto a provider payload. Message
+// versions are left to lib.EmailSendPayload. Attachment readers are replaced
+// with in-memory copies so the message can still be sent by the SMTP fallback.
+func payloadFromMessage(m *mailer.Message) (lib.EmailData, error) {
+	payload := lib.EmailData{
+		Sender: lib.Contact{
+			Email: m.From.Address,
+			Name:  m.From.Name,
+		},
+		ReplyTo: lib.Contact{
+			Email: os.Getenv("REPLY_EMAIL"),
+			Name:  os.Getenv("REPLY_NAME"),
+		},
+		Subject:     m.Subject,
+		HTMLContent: m.HTML,
+		TextContent: m.Text,
+	}
+	if payload.ReplyTo.Email == "" {
+		payload.ReplyTo = payload.Sender
+	}
+
+	for key, value := range m.Headers {
+		if strings.EqualFold(key, "Reply-To") {
+			if addr, err := mail.ParseAddress(value); err == nil {
+				payload.ReplyTo = lib.Contact{Email: addr.Address, Name: addr.Name}
+				continue
+			}
+		}
+		if payload.Headers == nil {
+			payload.Headers = map[string]string{}
+		}
+		payload.Headers[key] = value
+	}
+
+	var attachments []lib.BrevoAttachment
+	for _, files := range []map[string]io.Reader{m.Attachments, m.InlineAttachments} {
+		for name, r := range files {
+			b, err := io.ReadAll(r)
+			if err != nil {
+				return payload, fmt.Errorf("read attachment %s: %w", name, err)
+			}
+			files[name] = bytes.NewReader(b)
+			// Brevo has no cid support, inline files are sent as regular attachments
+			content := base64.StdEncoding.EncodeToString(b)
+			attachments = append(attachments, lib.BrevoAttachment{Name: name, Content: &content})
+		}
+	}
+	if len(attachments) > 0 {
+		payload.Attachment = &attachments
+	}
+	return payload, nil
+}
+
+func failedRecipients(recipients []lib.Recipient, failedEmails []string) []lib.Recipient {
+	failed := map[string]bool{}
+	for _, email := range failedEmails {
+		failed[strings.ToLower(email)] = true
+	}
+	var result []lib.Recipient
+	for _, r := range recipients {
+		if failed[strings.ToLower(r.Email)] {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+func contactMaps(addresses []mail.Address) []map[string]any {
+	var result []map[string]any
+	for _, a := range addresses {
+		c := map[string]any{"email": a.Address}
+		if a.Name != "" {
+			c["name"] = a.Name
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+func contactAddresses(contacts []map[string]any) []mail.Address {
+	var result []mail.Address
+	for _, c := range contacts {
+		email, _ := c["email"].(string)
+		name, _ := c["name"].(string)
+		result = append(result, mail.Address{Name: name, Address: email})
+	}
+	return result
+}
@@ -0,0 +1,178 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+// Auth methods recorded on auth events.
+const (
+	AuthMethodPassword = "password"
+	AuthMethodPasskey  = "passkey"
+	AuthMethodOTP      = "otp"
+	AuthMethodRecovery = "recovery"
+	AuthMethodOAuth    = "oauth"
+	AuthMethodToken    = "token"
+)
+
+// Auth event outcomes.
+const (
+	AuthSuccess = "success"
+	AuthFailure = "failure"
+	// AuthFlagged is a success that needs a look, like a passkey clone warning
+	// under the flag policy.
+	AuthFlagged = "flagged"
+)
+
+// AuthEvent is an entry in the auth_events audit collection (event, method,
+// outcome, collection, record, email, ip, user_agent, details).
+type AuthEvent struct {
+	Event      string
+	Method     string
+	Outcome    string
+	Collection string
+	RecordID   string
+	Email      string
+	Details    map[string]any
+}
+
+// RecordAuthEvent writes an audit entry with the client's IP and user agent.
+// Failures are logged and never block the request.
+func RecordAuthEvent(app core.App, e *core.RequestEvent, event AuthEvent) {
+	collection, err := app.FindCollectionByNameOrId("auth_events")
+	if err != nil {
+		log.Default().Println(fmt.Errorf("failed to find collection: %v", err))
+		return
+	}
+	record := core.NewRecord(collection)
+	record.Set("event", event.Event)
+	record.Set("method", event.Method)
+	record.Set("outcome", firstNonEmpty(event.Outcome, AuthSuccess))
+	record.Set("collection", event.Collection)
+	record.Set("record", event.RecordID)
+	record.Set("email", event.Email)
+	record.Set("details", event.Details)
+	if e != nil {
+		record.Set("ip", e.RealIP())
+		record.Set("user_agent", e.Request.UserAgent())
+	}
+	if err := app.Save(record); err != nil {
+		log.Default().Println(fmt.Errorf("failed to save auth event %s: %v", event.Event, err))
+	}
+}
+
+// RecordAuthFailure records a failed attempt with the error that caused it.
+func RecordAuthFailure(app core.App, e *core.RequestEvent, event AuthEvent, err error) {
+	event.Outcome = AuthFailure
+	if err != nil {
+		if event.Details == nil {
+			event.Details = map[string]any{}
+		}
+		event.Details["error"] = err.Error()
+	}
+	RecordAuthEvent(app, e, event)
+}
+
+// RegisterAuthEventHooks records every auth token PocketBase hands out, which
+// covers password, passkey, OTP and recovery logins, and failed password
+// logins. It also makes auth_events append-only.
+func RegisterAuthEventHooks(app core.App) {
+	app.OnRecordAuthRequest().BindFunc(func(e *core.RecordAuthRequestEvent) error {
+		// token refreshes have no auth method
+		if e.AuthMethod != "" {
+			RecordAuthEvent(e.App, e.RequestEvent, AuthEvent{
+				Event:      "login",
+				Method:     e.AuthMethod,
+				Collection: e.Collection.Name,
+				RecordID:   e.Record.Id,
+				Email:      e.Record.Email(),
+			})
+		}
+		return e.Next()
+	})
+
+	app.OnRecordAuthWithPasswordRequest().BindFunc(func(e *core.RecordAuthWithPasswordRequestEvent) error {
+		err := e.Next()
+		if err != nil {
+			event := AuthEvent{
+				Event:      "login",
+				Method:     AuthMethodPassword,
+				Collection: e.Collection.Name,
+				Email:      e.Identity,
+			}
+			if e.Record != nil {
+				event.RecordID = e.Record.Id
+			}
+			RecordAuthFailure(e.App, e.RequestEvent, event, err)
+		}
+		return err
+	})
+
+	errAppendOnly := errors.New("auth events can't be changed or deleted")
+	app.OnRecordUpdate("auth_events").BindFunc(func(e *core.RecordEvent) error {
+		return errAppendOnly
+	})
+	app.OnRecordDelete("auth_events").BindFunc(func(e *core.RecordEvent) error {
+		return errAppendOnly
+	})
+}
+
+func authEventsPage(e *core.RequestEvent, filter string, params dbx.Params) error {
+	limit, _ := strconv.Atoi(e.Request.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	page, _ := strconv.Atoi(e.Request.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	records, err := e.App.FindRecordsByFilter("auth_events", filter, "-created", limit, (page-1)*limit, params)
+	if err != nil {
+		return e.JSON(500, map[string]string{"error": "Failed to load auth events"})
+	}
+	return e.JSON(200, map[string]any{"page": page, "limit": limit, "items": records})
+}
+
+// RegisterAuthEventRoutes registers the audit log query for staff and the
+// recent activity of the logged in account.
+func RegisterAuthEventRoutes(sr *router.Router[*core.RequestEvent]) {
+	// ?record=, ?email=, ?event=, ?method=, ?outcome=, ?ip=, ?collection=,
+	// ?since=, ?until=, ?page= and ?limit= narrow the list
+	sr.GET("/auth/events", func(e *core.RequestEvent) error {
+		if e.Auth.Collection().Name != "users" {
+			return e.JSON(403, map[string]string{"error": "Unauthorized"})
+		}
+		filter := "id != ''"
+		params := dbx.Params{}
+		query := e.Request.URL.Query()
+		for _, field := range []string{"record", "email", "event", "method", "outcome", "ip", "collection"} {
+			if v := query.Get(field); v != "" {
+				filter += fmt.Sprintf(" && %s = {:%s}", field, field)
+				params[field] = v
+			}
+		}
+		if v := query.Get("since"); v != "" {
+			filter += " && created >= {:since}"
+			params["since"] = v
+		}
+		if v := query.Get("until"); v != "" {
+			filter += " && created <= {:until}"
+			params["until"] = v
+		}
+		return authEventsPage(e, filter, params)
+	}).Bind(apis.RequireAuth())
+
+	sr.GET("/auth/events/me", func(e *core.RequestEvent) error {
+		return authEventsPage(e, "collection = {:collection} && record = {:record}", dbx.Params{
+			"collection": e.Auth.Collection().Name,
+			"record":     e.Auth.Id,
+		})
+	}).Bind(apis.RequireAuth())
+}
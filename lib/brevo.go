@@ -1,17 +1,18 @@
 package lib
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"maps"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
 )
 
-// EmailSender sends an email using the Brevo API.
+// EmailSender sends an email using the configured EmailProvider (Brevo by default).
 // Parameters:
 //   - to: slice of recipient details (each recipient is a map with keys "email", "first_name", "last_name", etc.)
 //   - subject: email subject
@@ -21,7 +22,37 @@ import (
 //
 // Returns an error if the email fails to send.
 func EmailSender(to []Recipient, subject, message string, attachment *[]BrevoAttachment) error {
-	return EmailSenderFrom(
+	return EmailSenderCategory(EmailCategoryTransactional, to, subject, message, attachment)
+}
+
+// EmailSenderSensitive sends a transactional email that carries a secret, like
+// a login or recovery code. It is sent once without retries, and the outbox
+// only keeps a redacted copy.
+func EmailSenderSensitive(to []Recipient, subject, message string) error {
+	return EmailSendPayload(EmailCategoryTransactional, to, EmailData{
+		Sender:      Contact{Name: os.Getenv("SENDER_NAME"), Email: os.Getenv("SENDER_EMAIL")},
+		ReplyTo:     Contact{Name: os.Getenv("REPLY_NAME"), Email: os.Getenv("REPLY_EMAIL")},
+		Subject:     subject,
+		HTMLContent: message,
+		Sensitive:   true,
+	})
+}
+
+// EnqueueSensitiveEmail sends like EmailSenderSensitive in the background, so
+// a response doesn't take longer when an email was sent. Failures are logged.
+func EnqueueSensitiveEmail(to []Recipient, subject, message string) {
+	go func() {
+		if err := EmailSenderSensitive(to, subject, message); err != nil {
+			log.Default().Println(fmt.Errorf("failed to send %q: %w", subject, err))
+		}
+	}()
+}
+
+// EmailSenderCategory is EmailSender for a given email category. Recipients on
+// the suppression list for that category are skipped.
+func EmailSenderCategory(category string, to []Recipient, subject, message string, attachment *[]BrevoAttachment) error {
+	return EmailSenderFromCategory(
+		category,
 		Contact{
 			Name:  os.Getenv("SENDER_NAME"),
 			Email: os.Getenv("SENDER_EMAIL"),
@@ -37,7 +68,31 @@ func EmailSender(to []Recipient, subject, message string, attachment *[]BrevoAtt
 	)
 }
 
+// EmailSenderFrom sends a transactional email from the given sender.
 func EmailSenderFrom(from Contact, replyTo Contact, to []Recipient, subject, message string, attachment *[]BrevoAttachment) error {
+	return EmailSenderFromCategory(EmailCategoryTransactional, from, replyTo, to, subject, message, attachment)
+}
+
+func EmailSenderFromCategory(category string, from Contact, replyTo Contact, to []Recipient, subject, message string, attachment *[]BrevoAttachment) error {
+	return EmailSendPayload(category, to, EmailData{
+		Sender:      from,
+		ReplyTo:     replyTo,
+		Subject:     subject,
+		HTMLContent: message,
+		Attachment:  attachment,
+	})
+}
+
+// EmailSendPayload sends payload to each recipient as its own message version.
+// Sender, reply-to, content, attachments and headers come from payload, unless
+// a recipient has content of its own; any message versions already on it are
+// replaced.
+func EmailSendPayload(category string, to []Recipient, payload EmailData) error {
+	to = FilterRecipients(category, to)
+	if len(to) == 0 {
+		fmt.Println("No recipients left after applying the suppression list")
+		return nil
+	}
 
 	// Build messageVersions.
 	var messageVersions []MessageVersion
@@ -58,56 +113,78 @@ func EmailSenderFrom(from Contact, replyTo Contact, to []Recipient, subject, mes
 		if len(r.CC) > 0 {
 			mv.CC = r.CC
 		}
+		if len(r.BCC) > 0 {
+			mv.BCC = r.BCC
+		}
+		if r.Content != nil {
+			mv.Subject = r.Content.Subject
+			mv.HTMLContent = r.Content.HTML
+			mv.TextContent = r.Content.Text
+		}
 		messageVersions = append(messageVersions, mv)
 	}
-
-	// Build the complete payload.
-	payload := EmailData{
-		Sender:          from,
-		ReplyTo:         replyTo,
-		Subject:         subject,
-		HTMLContent:     message,
-		MessageVersions: messageVersions,
-	}
-	if attachment != nil {
-		payload.Attachment = attachment
+	if !IsTransactional(category) {
+		if err := addUnsubscribe(category, &payload, messageVersions); err != nil {
+			return err
+		}
 	}
+	payload.MessageVersions = messageVersions
+
+	return deliverEmail(category, payload)
+}
 
-	// Marshal payload to JSON.
-	b, err := json.Marshal(payload)
+// BrevoRequest Requires a payload of type []byte and returns an error.
+func BrevoRequest(payload []byte) error {
+	_, err := brevoPost(payload)
+	return err
+}
+
+// brevoHTTPClient times out so a hung request fails and can be retried.
+var brevoHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// brevoPost sends a transactional email request and returns the response body.
+func brevoPost(payload []byte) (string, error) {
+	// Prepare HTTP request.
+	req, err := http.NewRequest("POST", "https://api.brevo.com/v3/smtp/email", strings.NewReader(string(payload)))
 	if err != nil {
-		return fmt.Errorf("marshal payload: %w", err)
+		return "", fmt.Errorf("create request: %w", err)
 	}
-	err = BrevoRequest(b)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("accept", "application/json")
+	req.Header.Set("api-key", os.Getenv("BREVO_API_KEY"))
+
+	resp, err := brevoHTTPClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("brevo request: %w", err)
+		return "", fmt.Errorf("do request: %w", err)
 	}
+	defer resp.Body.Close()
 
-	return nil
+	body, _ := io.ReadAll(resp.Body)
+	// If response is not OK, return the error body.
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", &BrevoAPIError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return string(body), nil
 }
 
-// BrevoRequest Requires a payload of type []byte and returns an error.
-func BrevoRequest(payload []byte) error {
-	// Prepare HTTP request.
-	req, err := http.NewRequest("POST", "https://api.brevo.com/v3/smtp/email", strings.NewReader(string(payload)))
+// BrevoCancelScheduled cancels scheduled emails by batch or message id.
+func BrevoCancelScheduled(identifier string) error {
+	req, err := http.NewRequest("DELETE", "https://api.brevo.com/v3/smtp/email/"+url.PathEscape(identifier), nil)
 	if err != nil {
 		return fmt.Errorf("create request: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("accept", "application/json")
 	req.Header.Set("api-key", os.Getenv("BREVO_API_KEY"))
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := brevoHTTPClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("do request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	// If response is not OK, read the error body.
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
+		return &BrevoAPIError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 	return nil
 }
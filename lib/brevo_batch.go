@@ -0,0 +1,178 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// defaultBrevoBatchSize is the most messageVersions Brevo accepts in one call.
+	defaultBrevoBatchSize = 1000
+	brevoBatchWorkers     = 4
+	brevoBatchAttempts    = 3
+)
+
+var (
+	brevoLimiter    = rate.NewLimiter(rate.Every(time.Second/5), 1) // 5 req/s to stay well under the Brevo limits
+	batchRetryDelay = 2 * time.Second
+)
+
+// BrevoAPIError is a non 2xx response from the Brevo API.
+type BrevoAPIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *BrevoAPIError) Error() string {
+	return fmt.Sprintf("API error (status %d): %s", e.StatusCode, e.Body)
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *BrevoAPIError) Temporary() bool {
+	return e.StatusCode == 429 || e.StatusCode >= 500
+}
+
+// FailedRecipient is a recipient whose batch could not be delivered.
+type FailedRecipient struct {
+	Email string
+	Err   error
+}
+
+// PartialSendError is returned when some batches of a send failed after all
+// retries. Recipients of the other batches were delivered and are not listed.
+type PartialSendError struct {
+	Total  int
+	Failed []FailedRecipient
+}
+
+func (e *PartialSendError) Error() string {
+	return fmt.Sprintf("failed to send to %d of %d recipients: %s", len(e.Failed), e.Total, strings.Join(e.FailedEmails(), ", "))
+}
+
+// FailedEmails lists the addresses that were not delivered.
+func (e *PartialSendError) FailedEmails() []string {
+	emails := make([]string, len(e.Failed))
+	for i, f := range e.Failed {
+		emails[i] = f.Email
+	}
+	return emails
+}
+
+func brevoBatchSize() int {
+	if n, err := strconv.Atoi(os.Getenv("BREVO_BATCH_SIZE")); err == nil && n > 0 && n < defaultBrevoBatchSize {
+		return n
+	}
+	return defaultBrevoBatchSize
+}
+
+// splitMessageVersions splits a payload into copies that carry at most size
+// messageVersions each.
+func splitMessageVersions(payload EmailData, size int) []EmailData {
+	if len(payload.MessageVersions) <= size {
+		return []EmailData{payload}
+	}
+	var batches []EmailData
+	for start := 0; start < len(payload.MessageVersions); start += size {
+		end := min(start+size, len(payload.MessageVersions))
+		batch := payload
+		batch.MessageVersions = payload.MessageVersions[start:end]
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// isRetryable reports whether the outbox should send a failed batch again. API
+// errors are retried only for rate limits and server errors; transport errors
+// always.
+func isRetryable(err error) bool {
+	var apiErr *BrevoAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	return true
+}
+
+// retryInBatch reports whether sendBatchWithRetry should send a failed batch
+// again right away. Only API errors qualify: after a transport error or a
+// timeout Brevo may have accepted the batch, so it is left to the outbox and
+// not resent on top of the outbox retries.
+func retryInBatch(err error) bool {
+	var apiErr *BrevoAPIError
+	return errors.As(err, &apiErr) && apiErr.Temporary()
+}
+
+// sendInBatches sends the payload in batches of at most size messageVersions,
+// concurrently and under the Brevo rate limiter. Batches rejected with a
+// rate limit or server error are retried on their own, so delivered batches
+// are never resent. Remaining failures are reported as a *PartialSendError.
+func sendInBatches(ctx context.Context, payload EmailData, size int, send func(EmailData) error) error {
+	batches := splitMessageVersions(payload, size)
+	if len(batches) == 1 {
+		// still limited and retried, but the error is returned as is
+		return sendBatchWithRetry(ctx, batches[0], send)
+	}
+
+	errs := make([]error, len(batches))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(brevoBatchWorkers, len(batches)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errs[i] = sendBatchWithRetry(ctx, batches[i], send)
+			}
+		}()
+	}
+	for i := range batches {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	partial := &PartialSendError{Total: len(payload.MessageVersions)}
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		fmt.Printf("brevo batch %d/%d failed: %v\n", i+1, len(batches), err)
+		for _, v := range batches[i].MessageVersions {
+			for _, to := range v.To {
+				partial.Failed = append(partial.Failed, FailedRecipient{Email: to.Email, Err: err})
+			}
+		}
+	}
+	if len(partial.Failed) > 0 {
+		return partial
+	}
+	return nil
+}
+
+func sendBatchWithRetry(ctx context.Context, batch EmailData, send func(EmailData) error) error {
+	var err error
+	for attempt := 1; attempt <= brevoBatchAttempts; attempt++ {
+		if waitErr := brevoLimiter.Wait(ctx); waitErr != nil {
+			return waitErr
+		}
+		err = send(batch)
+		if err == nil || !retryInBatch(err) {
+			return err
+		}
+		if attempt < brevoBatchAttempts {
+			select {
+			case <-time.After(batchRetryDelay * time.Duration(attempt)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSendInBatchesRetriesOnlyFailedBatches(t *testing.T) {
+	delay := batchRetryDelay
+	t.Cleanup(func() { batchRetryDelay = delay })
+	batchRetryDelay = time.Millisecond
+	var payload EmailData
+	for i := range 10 {
+		payload.MessageVersions = append(payload.MessageVersions, MessageVersion{
+			To: []Contact{{Email: fmt.Sprintf("member%d@example.com", i)}},
+		})
+	}
+
+	var mu sync.Mutex
+	sends := map[string]int{}
+	err := sendInBatches(context.Background(), payload, 3, func(batch EmailData) error {
+		first := batch.MessageVersions[0].To[0].Email
+		mu.Lock()
+		sends[first]++
+		n := sends[first]
+		mu.Unlock()
+		switch first {
+		case "member3@example.com":
+			if n == 1 {
+				return &BrevoAPIError{StatusCode: 503, Body: "unavailable"}
+			}
+		case "member9@example.com":
+			return &BrevoAPIError{StatusCode: 400, Body: "bad request"}
+		}
+		return nil
+	})
+
+	var partial *PartialSendError
+	if !errors.As(err, &partial) {
+		t.Fatalf("expected a PartialSendError, got %v", err)
+	}
+	if len(partial.Failed) != 1 || partial.Failed[0].Email != "member9@example.com" {
+		t.Fatalf("unexpected failed recipients %v", partial.FailedEmails())
+	}
+	want := map[string]int{
+		"member0@example.com": 1,
+		"member3@example.com": 2,
+		"member6@example.com": 1,
+		"member9@example.com": 1,
+	}
+	for first, n := range want {
+		if sends[first] != n {
+			t.Errorf("batch starting at %s sent %d times, want %d", first, sends[first], n)
+		}
+	}
+}
+
+func TestSendInBatchesRetriesSingleBatch(t *testing.T) {
+	delay := batchRetryDelay
+	t.Cleanup(func() { batchRetryDelay = delay })
+	batchRetryDelay = time.Millisecond
+	payload := EmailData{MessageVersions: []MessageVersion{{To: []Contact{{Email: "member@example.com"}}}}}
+
+	sends := 0
+	err := sendInBatches(context.Background(), payload, 3, func(batch EmailData) error {
+		sends++
+		if sends == 1 {
+			return &BrevoAPIError{StatusCode: 429, Body: "too many requests"}
+		}
+		return nil
+	})
+	if err != nil || sends != 2 {
+		t.Fatalf("expected one retry, got %d sends and %v", sends, err)
+	}
+}
+
+func TestSendInBatchesLeavesTransportErrorsToTheOutbox(t *testing.T) {
+	delay := batchRetryDelay
+	t.Cleanup(func() { batchRetryDelay = delay })
+	batchRetryDelay = time.Millisecond
+	payload := EmailData{MessageVersions: []MessageVersion{{To: []Contact{{Email: "member@example.com"}}}}}
+
+	sends := 0
+	timeout := fmt.Errorf("brevo request: %w", context.DeadlineExceeded)
+	err := sendInBatches(context.Background(), payload, 3, func(batch EmailData) error {
+		sends++
+		return timeout
+	})
+	if sends != 1 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a single send, got %d sends and %v", sends, err)
+	}
+	if _, _, retry := retryRemainder(payload, err); !retry {
+		t.Error("the outbox should retry a transport error")
+	}
+}
@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+// BrevoEvent is a transactional email event posted by the Brevo webhook.
+type BrevoEvent struct {
+	Event     string `json:"event"`
+	Email     string `json:"email"`
+	MessageID string `json:"message-id"`
+	Subject   string `json:"subject"`
+	Reason    string `json:"reason"`
+	Link      string `json:"link"`
+	Tag       string `json:"tag"`
+	Date      string `json:"date"`
+	TsEvent   int64  `json:"ts_event"`
+}
+
+// brevoEventTypes are the events we keep; anything else Brevo sends is acknowledged and dropped.
+var brevoEventTypes = map[string]bool{
+	"delivered":     true,
+	"hard_bounce":   true,
+	"soft_bounce":   true,
+	"spam":          true,
+	"opened":        true,
+	"unique_opened": true,
+	"click":         true,
+	"unsubscribed":  true,
+}
+
+// RegisterBrevoWebhook registers the Brevo delivery event webhook and the
+// admin route that shows a member's email history.
+func RegisterBrevoWebhook(sr *router.Router[*core.RequestEvent], app *pocketbase.PocketBase) {
+	sr.POST("/brevo/webhook", func(e *core.RequestEvent) error {
+		if !validBrevoWebhookToken(e.Request) {
+			return apis.NewUnauthorizedError("Invalid webhook token.", nil)
+		}
+		body, err := io.ReadAll(e.Request.Body)
+		if err != nil {
+			return e.BadRequestError("Failed to read webhook body", err)
+		}
+		// Brevo posts a single event, or an array when batching is enabled
+		var events []BrevoEvent
+		if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+			err = json.Unmarshal(body, &events)
+		} else {
+			var event BrevoEvent
+			err = json.Unmarshal(body, &event)
+			events = append(events, event)
+		}
+		if err != nil {
+			return e.BadRequestError("Failed to parse webhook event", err)
+		}
+		for _, event := range events {
+			if err := processBrevoEvent(event, app); err != nil {
+				log.Default().Println(err)
+			}
+		}
+		return e.JSON(http.StatusOK, map[string]string{"status": "success"})
+	})
+
+	sr.GET("/brevo/events/{memberID}", func(e *core.RequestEvent) error {
+		if e.Auth.Collection().Name != "users" {
+			return e.JSON(403, map[string]string{"error": "Unauthorized"})
+		}
+		memberID := e.Request.PathValue("memberID")
+		member, err := app.FindRecordById("members", memberID)
+		if err != nil {
+			return e.JSON(404, map[string]string{"error": "Member not found"})
+		}
+		events, err := app.FindRecordsByFilter("email_events", "member = {:member}", "-event_at", 200, 0, dbx.Params{"member": memberID})
+		if err != nil {
+			return e.JSON(500, map[string]string{"error": "Failed to load email events"})
+		}
+		return e.JSON(http.StatusOK, map[string]any{
+			"email":       member.GetString("email"),
+			"hard_bounce": member.GetBool("email_bounced"),
+			"events":      events,
+		})
+	}).Bind(apis.RequireAuth())
+}
+
+// validBrevoWebhookToken checks the shared secret set in BREVO_WEBHOOK_TOKEN,
+// sent either as a bearer token or as the token query parameter. Without a
+// configured secret every request is rejected.
+func validBrevoWebhookToken(r *http.Request) bool {
+	expected := os.Getenv("BREVO_WEBHOOK_TOKEN")
+	if expected == "" {
+		fmt.Println("BREVO_WEBHOOK_TOKEN is not set, rejecting Brevo webhook")
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+func processBrevoEvent(event BrevoEvent, app *pocketbase.PocketBase) error {
+	if !brevoEventTypes[event.Event] || event.Email == "" {
+		return nil
+	}
+	eventAt := time.Now().UTC()
+	if event.TsEvent > 0 {
+		eventAt = time.Unix(event.TsEvent, 0).UTC()
+	}
+
+	collection, err := app.FindCollectionByNameOrId("email_events")
+	if err != nil {
+		return fmt.Errorf("failed to find collection: %v", err)
+	}
+	record := core.NewRecord(collection)
+	record.Set("event", event.Event)
+	record.Set("email", strings.ToLower(event.Email))
+	record.Set("message_id", event.MessageID)
+	record.Set("subject", event.Subject)
+	record.Set("reason", event.Reason)
+	record.Set("link", event.Link)
+	record.Set("tag", event.Tag)
+	record.Set("event_at", eventAt)
+	if b, err := json.Marshal(event); err == nil {
+		record.Set("payload", string(b))
+	}
+
+	member, err := app.FindAuthRecordByEmail("members", event.Email)
+	if err == nil {
+		record.Set("member", member.Id)
+	}
+	if err := app.Save(record); err != nil {
+		return fmt.Errorf("failed to save email event: %v", err)
+	}
+
+	switch event.Event {
+	case "hard_bounce", "spam", "unsubscribed":
+		if err := AddSuppression(app, event.Email, event.Event, SuppressionScopeMarketing, "brevo"); err != nil {
+			log.Default().Println(fmt.Errorf("failed to add suppression for %s: %v", event.Email, err))
+		}
+	}
+
+	if member != nil && event.Event == "hard_bounce" && !member.GetBool("email_bounced") {
+		member.Set("email_bounced", true)
+		member.Set("email_bounced_at", eventAt)
+		if err := app.Save(member); err != nil {
+			return fmt.Errorf("failed to flag bounced member: %v", err)
+		}
+	}
+	return nil
+}
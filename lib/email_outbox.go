@@ -0,0 +1,415 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Outbox statuses.
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed"
+	// OutboxCancelled is a pending email that won't be sent, because it was
+	// delivered some other way or its scheduled send was cancelled.
+	OutboxCancelled = "cancelled"
+)
+
+const (
+	outboxMaxAttempts = 8
+	outboxMaxDelay    = 6 * time.Hour
+	// outboxStuckAfter is how long a send may stay "sending" before it is
+	// assumed the process died mid-send and it is marked failed.
+	outboxStuckAfter = 15 * time.Minute
+)
+
+var outboxBaseDelay = time.Minute
+
+// ErrOutboxClaimed is returned when another worker or request started sending
+// an outbox email first. That send delivers it, so callers treat it like a
+// queued retry.
+var ErrOutboxClaimed = errors.New("email is already being sent")
+
+// RetryQueuedError is returned when a send failed but the outbox will try it
+// again. Callers that deliver the email some other way should call
+// CancelOutboxRetry first, so it isn't sent twice.
+type RetryQueuedError struct {
+	OutboxID string
+	Err      error
+}
+
+func (e *RetryQueuedError) Error() string {
+	return fmt.Sprintf("queued for retry: %v", e.Err)
+}
+
+func (e *RetryQueuedError) Unwrap() error {
+	return e.Err
+}
+
+// queuedForRetry reports whether err means the outbox will send the rest of
+// the email later, or is sending it already. Jobs that run again on error
+// treat it as done, otherwise the recipients that did get it would get it
+// twice.
+func queuedForRetry(err error) bool {
+	var queued *RetryQueuedError
+	return errors.As(err, &queued) || errors.Is(err, ErrOutboxClaimed)
+}
+
+// ResponseSender is implemented by providers that report the raw provider
+// response, which the outbox keeps with each send.
+type ResponseSender interface {
+	SendWithResponse(payload EmailData) (string, error)
+}
+
+// outboxBackoff is the wait after the given number of failed attempts.
+func outboxBackoff(attempts int) time.Duration {
+	delay := outboxBaseDelay
+	for i := 1; i < attempts && delay < outboxMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, outboxMaxDelay)
+}
+
+func sendWithProvider(payload EmailData) (string, error) {
+	provider := CurrentEmailProvider()
+	var response string
+	var err error
+	if rs, ok := provider.(ResponseSender); ok {
+		response, err = rs.SendWithResponse(payload)
+	} else {
+		err = provider.Send(payload)
+	}
+	if err != nil {
+		return response, fmt.Errorf("%s request: %w", provider.Name(), err)
+	}
+	return response, nil
+}
+
+// retryRemainder returns the part of payload that should be sent again after
+// err, the recipients that failed for good, and whether a retry may help.
+// After a partial send only the failed recipients are kept, so nobody gets the
+// email twice.
+func retryRemainder(payload EmailData, err error) (EmailData, []string, bool) {
+	var partial *PartialSendError
+	if !errors.As(err, &partial) {
+		return payload, nil, isRetryable(err)
+	}
+	retryable := map[string]bool{}
+	var dropped []string
+	for _, f := range partial.Failed {
+		if isRetryable(f.Err) {
+			retryable[f.Email] = true
+		} else {
+			dropped = append(dropped, f.Email)
+		}
+	}
+	var versions []MessageVersion
+	for _, v := range payload.MessageVersions {
+		if len(v.To) > 0 && retryable[v.To[0].Email] {
+			versions = append(versions, v)
+		}
+	}
+	payload.MessageVersions = versions
+	return payload, dropped, len(versions) > 0
+}
+
+// outboxError is the last_error of a record, listing the recipients that were
+// given up on so they aren't lost when the rest is retried.
+func outboxError(sendErr error, dropped []string) string {
+	var parts []string
+	if sendErr != nil {
+		parts = append(parts, sendErr.Error())
+	}
+	if len(dropped) > 0 {
+		parts = append(parts, "not delivered to: "+strings.Join(dropped, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// redactPayload strips the content and per-recipient params of a sensitive
+// email, keeping who it went to.
+func redactPayload(payload EmailData) EmailData {
+	payload.HTMLContent = "[redacted]"
+	payload.TextContent = ""
+	versions := make([]MessageVersion, len(payload.MessageVersions))
+	for i, v := range payload.MessageVersions {
+		v.Params = nil
+		v.HTMLContent = ""
+		v.TextContent = ""
+		versions[i] = v
+	}
+	payload.MessageVersions = versions
+	return payload
+}
+
+// deliverSensitive sends a sensitive email directly and records a redacted
+// copy in the outbox. It isn't retried, since the outbox can't send it again.
+func deliverSensitive(category string, payload EmailData) error {
+	response, sendErr := sendWithProvider(payload)
+	if emailApp == nil {
+		return sendErr
+	}
+	collection, err := emailApp.FindCollectionByNameOrId("email_outbox")
+	if err != nil {
+		return sendErr
+	}
+	record := newOutboxRecord(collection, category, redactPayload(payload))
+	record.Set("redacted", true)
+	record.Set("attempts", 1)
+	record.Set("provider", CurrentEmailProvider().Name())
+	record.Set("provider_response", response)
+	if sendErr != nil {
+		record.Set("status", OutboxFailed)
+		record.Set("last_error", sendErr.Error())
+	} else {
+		record.Set("status", OutboxSent)
+		record.Set("sent_at", time.Now().UTC())
+	}
+	if err := emailApp.Save(record); err != nil {
+		log.Default().Println(fmt.Errorf("failed to write email outbox: %w", err))
+	}
+	return sendErr
+}
+
+func newOutboxRecord(collection *core.Collection, category string, payload EmailData) *core.Record {
+	record := core.NewRecord(collection)
+	record.Set("category", categoryOrDefault(category))
+	record.Set("subject", payload.Subject)
+	record.Set("payload", payload)
+	record.Set("recipient_count", len(payload.MessageVersions))
+	record.Set("status", OutboxPending)
+	record.Set("attempts", 0)
+	record.Set("next_attempt_at", time.Now().UTC())
+	return record
+}
+
+// deliverEmail writes the email to the outbox and makes the first delivery
+// attempt. Temporary failures are left for ProcessEmailOutbox and returned as
+// a *RetryQueuedError; permanent failures are returned as they are. Without an app, or if the outbox
+// can't be written, the email is sent directly. Sensitive emails skip the
+// outbox, see deliverSensitive.
+func deliverEmail(category string, payload EmailData) error {
+	if payload.Sensitive {
+		return deliverSensitive(category, payload)
+	}
+	if emailApp == nil {
+		_, err := sendWithProvider(payload)
+		return err
+	}
+	collection, err := emailApp.FindCollectionByNameOrId("email_outbox")
+	if err != nil {
+		log.Default().Println(fmt.Errorf("email outbox unavailable, sending directly: %w", err))
+		_, err := sendWithProvider(payload)
+		return err
+	}
+	// written already claimed, so ProcessEmailOutbox can't pick it up while
+	// the first attempt is under way
+	record := newOutboxRecord(collection, category, payload)
+	record.Set("batch_id", payload.BatchID)
+	record.Set("status", OutboxSending)
+	record.Set("attempts", 1)
+	if err := emailApp.Save(record); err != nil {
+		log.Default().Println(fmt.Errorf("failed to write email outbox, sending directly: %w", err))
+		_, err := sendWithProvider(payload)
+		return err
+	}
+	return sendOutboxRecord(emailApp, record, payload)
+}
+
+// deliverOutboxRecord makes one delivery attempt for an outbox record. When the
+// send is retried later, the error is a *RetryQueuedError.
+func deliverOutboxRecord(app core.App, record *core.Record) error {
+	var payload EmailData
+	if err := record.UnmarshalJSONField("payload", &payload); err != nil {
+		record.Set("status", OutboxFailed)
+		record.Set("last_error", err.Error())
+		return errors.Join(err, app.Save(record))
+	}
+	if err := claimOutboxRecord(app, record, record.GetInt("attempts")+1); err != nil {
+		return err
+	}
+	return sendOutboxRecord(app, record, payload)
+}
+
+// sendOutboxRecord sends the payload of a claimed outbox record and stores the
+// outcome.
+func sendOutboxRecord(app core.App, record *core.Record, payload EmailData) error {
+	attempts := record.GetInt("attempts")
+	response, sendErr := sendWithProvider(payload)
+	record.Set("provider", CurrentEmailProvider().Name())
+	record.Set("provider_response", response)
+	var dropped []string
+	record.UnmarshalJSONField("dropped", &dropped)
+	switch {
+	case sendErr == nil:
+		record.Set("status", OutboxSent)
+		record.Set("sent_at", time.Now().UTC())
+		record.Set("last_error", outboxError(nil, dropped))
+	default:
+		remainder, failed, retryable := retryRemainder(payload, sendErr)
+		dropped = append(dropped, failed...)
+		record.Set("dropped", dropped)
+		record.Set("last_error", outboxError(sendErr, dropped))
+		if retryable && attempts < outboxMaxAttempts {
+			next := time.Now().UTC().Add(outboxBackoff(attempts))
+			log.Default().Printf("Email %q failed (attempt %d), retrying at %s: %v\n", payload.Subject, attempts, next.Format(time.RFC3339), sendErr)
+			record.Set("status", OutboxPending)
+			record.Set("next_attempt_at", next)
+			record.Set("payload", remainder)
+			sendErr = &RetryQueuedError{OutboxID: record.Id, Err: sendErr}
+		} else {
+			record.Set("status", OutboxFailed)
+		}
+	}
+	if err := app.Save(record); err != nil {
+		return errors.Join(sendErr, fmt.Errorf("failed to update email outbox: %w", err))
+	}
+	return sendErr
+}
+
+// claimOutboxRecord marks record as sending with the given attempt count, as
+// long as its status hasn't changed since it was loaded, so only one worker or
+// request ever sends it.
+func claimOutboxRecord(app core.App, record *core.Record, attempts int) error {
+	res, err := app.DB().Update("email_outbox", dbx.Params{
+		"status":   OutboxSending,
+		"attempts": attempts,
+		"updated":  types.NowDateTime().String(),
+	}, dbx.HashExp{"id": record.Id, "status": record.GetString("status")}).Execute()
+	if err != nil {
+		return fmt.Errorf("failed to update email outbox: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return ErrOutboxClaimed
+	}
+	record.Set("status", OutboxSending)
+	record.Set("attempts", attempts)
+	return nil
+}
+
+// failStuckOutbox gives up on emails left "sending" by a process that stopped
+// mid-send. They may have gone out already, so they aren't sent again; staff
+// can resend them from the outbox.
+func failStuckOutbox(app core.App, now time.Time) {
+	_, err := app.DB().Update("email_outbox", dbx.Params{
+		"status":     OutboxFailed,
+		"last_error": "interrupted while sending, it may or may not have been delivered",
+	}, dbx.And(
+		dbx.HashExp{"status": OutboxSending},
+		dbx.NewExp("updated <= {:stuck}", dbx.Params{"stuck": now.Add(-outboxStuckAfter).Format("2006-01-02 15:04:05.000Z")}),
+	)).Execute()
+	if err != nil {
+		log.Default().Println(fmt.Errorf("failed to update stuck email outbox: %w", err))
+	}
+}
+
+// ProcessEmailOutbox retries pending emails that are due. It runs every minute
+// from cron.
+func ProcessEmailOutbox(app core.App) {
+	now := time.Now().UTC()
+	failStuckOutbox(app, now)
+	records, err := app.FindRecordsByFilter(
+		"email_outbox",
+		"status = {:pending} && next_attempt_at <= {:now}",
+		"next_attempt_at",
+		100,
+		0,
+		dbx.Params{
+			"pending": OutboxPending,
+			"now":     now.Format("2006-01-02 15:04:05.000Z"),
+		},
+	)
+	if err != nil {
+		log.Default().Println(fmt.Errorf("failed to load email outbox: %w", err))
+		return
+	}
+	for _, record := range records {
+		if err := deliverOutboxRecord(app, record); err != nil && !errors.Is(err, ErrOutboxClaimed) {
+			log.Default().Println(fmt.Errorf("email outbox %s: %w", record.Id, err))
+		}
+	}
+}
+
+// CancelOutboxBatch stops the pending outbox emails of a scheduled batch and
+// returns how many were stopped.
+func CancelOutboxBatch(app core.App, batchID string) (int64, error) {
+	if batchID == "" {
+		return 0, nil
+	}
+	res, err := app.DB().Update("email_outbox", dbx.Params{
+		"status":     OutboxCancelled,
+		"last_error": "scheduled email cancelled",
+	}, dbx.HashExp{"batch_id": batchID, "status": OutboxPending}).Execute()
+	if err != nil {
+		return 0, fmt.Errorf("failed to cancel email outbox: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// CancelOutboxRetry stops a pending outbox email from being sent, and reports
+// whether it was stopped. It is false when the outbox already started sending.
+func CancelOutboxRetry(app core.App, id, reason string) bool {
+	res, err := app.DB().Update("email_outbox", dbx.Params{
+		"status":     OutboxCancelled,
+		"last_error": reason,
+	}, dbx.HashExp{"id": id, "status": OutboxPending}).Execute()
+	if err != nil {
+		log.Default().Println(fmt.Errorf("failed to cancel email outbox %s: %w", id, err))
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+// EmailOutboxRoute lists the outbox, newest first. ?status= filters by status.
+// Only staff accounts from the users collection may call it.
+func EmailOutboxRoute(e *core.RequestEvent) error {
+	if e.Auth.Collection().Name != "users" {
+		return e.JSON(403, map[string]string{"error": "Unauthorized"})
+	}
+	filter := "id != ''"
+	params := dbx.Params{}
+	if status := e.Request.URL.Query().Get("status"); status != "" {
+		filter = "status = {:status}"
+		params["status"] = status
+	}
+	records, err := e.App.FindRecordsByFilter("email_outbox", filter, "-created", 200, 0, params)
+	if err != nil {
+		return e.JSON(500, map[string]string{"error": "Failed to load email outbox"})
+	}
+	return e.JSON(200, map[string]any{"items": records})
+}
+
+// EmailOutboxResendRoute sends an outbox email again right away, whatever its
+// status, with a fresh set of attempts.
+func EmailOutboxResendRoute(e *core.RequestEvent) error {
+	if e.Auth.Collection().Name != "users" {
+		return e.JSON(403, map[string]string{"error": "Unauthorized"})
+	}
+	record, err := e.App.FindRecordById("email_outbox", e.Request.PathValue("id"))
+	if err != nil {
+		return e.JSON(404, map[string]string{"error": "Email not found"})
+	}
+	if record.GetString("status") == OutboxSending {
+		return e.JSON(409, map[string]string{"error": "Email is being sent"})
+	}
+	if record.GetBool("redacted") {
+		return e.JSON(409, map[string]string{"error": "Email held a secret and was not kept, it can't be resent"})
+	}
+	record.Set("attempts", 0)
+	record.Set("dropped", nil)
+	if err := deliverOutboxRecord(e.App, record); errors.Is(err, ErrOutboxClaimed) {
+		return e.JSON(409, map[string]string{"error": "Email is being sent"})
+	} else if err != nil {
+		return e.JSON(502, map[string]any{"error": err.Error(), "email": record})
+	}
+	return e.JSON(200, record)
+}
@@ -0,0 +1,49 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute}
+	for i, w := range want {
+		if got := outboxBackoff(i + 1); got != w {
+			t.Errorf("outboxBackoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+	if got := outboxBackoff(20); got != outboxMaxDelay {
+		t.Errorf("outboxBackoff(20) = %s, want %s", got, outboxMaxDelay)
+	}
+}
+
+func TestRetryRemainder(t *testing.T) {
+	payload := EmailData{MessageVersions: []MessageVersion{
+		{To: []Contact{{Email: "a@example.com"}}},
+		{To: []Contact{{Email: "b@example.com"}}},
+		{To: []Contact{{Email: "c@example.com"}}},
+	}}
+
+	if _, _, retry := retryRemainder(payload, &BrevoAPIError{StatusCode: 400}); retry {
+		t.Error("a 400 should not be retried")
+	}
+	if rest, _, retry := retryRemainder(payload, &BrevoAPIError{StatusCode: 503}); !retry || len(rest.MessageVersions) != 3 {
+		t.Errorf("a 503 should retry everyone, got %v %d", retry, len(rest.MessageVersions))
+	}
+
+	partial := &PartialSendError{Total: 3, Failed: []FailedRecipient{
+		{Email: "b@example.com", Err: &BrevoAPIError{StatusCode: 502}},
+		{Email: "c@example.com", Err: &BrevoAPIError{StatusCode: 400}},
+	}}
+	rest, dropped, retry := retryRemainder(payload, errors.Join(errors.New("brevo request"), partial))
+	if !retry || len(rest.MessageVersions) != 1 || rest.MessageVersions[0].To[0].Email != "b@example.com" {
+		t.Errorf("only b should be retried, got %v %+v", retry, rest.MessageVersions)
+	}
+	if len(dropped) != 1 || dropped[0] != "c@example.com" {
+		t.Errorf("c should be reported as dropped, got %v", dropped)
+	}
+	if got := outboxError(errors.New("brevo request"), dropped); got != "brevo request; not delivered to: c@example.com" {
+		t.Errorf("outboxError = %q", got)
+	}
+}
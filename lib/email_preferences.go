@@ -0,0 +1,287 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+// unsubscribeClaims is the payload of a signed unsubscribe token.
+type unsubscribeClaims struct {
+	Email    string `json:"e"`
+	Category string `json:"c"`
+}
+
+// unsubscribeSecret is the key unsubscribe tokens are signed with. Tokens are
+// neither signed nor accepted without one.
+func unsubscribeSecret() ([]byte, error) {
+	secret := firstNonEmpty(os.Getenv("UNSUBSCRIBE_SECRET"), os.Getenv("shared_secret"))
+	if secret == "" {
+		return nil, fmt.Errorf("UNSUBSCRIBE_SECRET is not set")
+	}
+	return []byte(secret), nil
+}
+
+func publicURL() string {
+	return strings.TrimSuffix(firstNonEmpty(os.Getenv("PUBLIC_URL"), "https://pocket.nextmil.org"), "/")
+}
+
+// UnsubscribeToken signs an email address and category. The token does not
+// expire, so links in old emails keep working.
+func UnsubscribeToken(email, category string) (string, error) {
+	secret, err := unsubscribeSecret()
+	if err != nil {
+		return "", err
+	}
+	payload, _ := json.Marshal(unsubscribeClaims{Email: strings.ToLower(email), Category: category})
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func parseUnsubscribeToken(token string) (unsubscribeClaims, error) {
+	var claims unsubscribeClaims
+	secret, err := unsubscribeSecret()
+	if err != nil {
+		return claims, err
+	}
+	payloadB64, sigB64, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, fmt.Errorf("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(payloadB64)
+	if err != nil {
+		return claims, fmt.Errorf("malformed token: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sigB64)
+	if err != nil {
+		return claims, fmt.Errorf("malformed token: %w", err)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return claims, fmt.Errorf("invalid token signature")
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, fmt.Errorf("malformed token: %w", err)
+	}
+	return claims, nil
+}
+
+// UnsubscribeURL is the one-click unsubscribe link for an address and category.
+func UnsubscribeURL(email, category string) (string, error) {
+	token, err := UnsubscribeToken(email, category)
+	if err != nil {
+		return "", err
+	}
+	return publicURL() + "/email/unsubscribe?token=" + url.QueryEscape(token), nil
+}
+
+// addUnsubscribe gives every version of a marketing message its own
+// unsubscribe_url param, which the List-Unsubscribe headers and the footer
+// link refer to. Providers render the headers per recipient; Brevo doesn't
+// fill in params in headers, so BrevoProvider sends such messages one version
+// per request. The footer is only appended when the template doesn't place
+// {{params.unsubscribe_url}} itself.
+func addUnsubscribe(category string, payload *EmailData, versions []MessageVersion) error {
+	for i := range versions {
+		if len(versions[i].To) == 0 {
+			continue
+		}
+		link, err := UnsubscribeURL(versions[i].To[0].Email, category)
+		if err != nil {
+			return fmt.Errorf("unsubscribe link: %w", err)
+		}
+		versions[i].Params["unsubscribe_url"] = link
+	}
+	payload.Headers = mergeHeaders(payload.Headers, map[string]string{
+		"List-Unsubscribe":      "<{{params.unsubscribe_url}}>",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	})
+	payload.HTMLContent = withUnsubscribeFooter(payload.HTMLContent)
+	for i := range versions {
+		if versions[i].HTMLContent != "" {
+			versions[i].HTMLContent = withUnsubscribeFooter(versions[i].HTMLContent)
+		}
+	}
+	return nil
+}
+
+func withUnsubscribeFooter(content string) string {
+	if strings.Contains(content, "params.unsubscribe_url") {
+		return content
+	}
+	return content + `<p style="font-size:12px;color:#888;text-align:center;">` +
+		`Don't want these emails? <a href="{{params.unsubscribe_url}}">Unsubscribe</a></p>`
+}
+
+// filterOptedOut drops recipients whose member record opted out of category.
+func filterOptedOut(category string, to []Recipient) []Recipient {
+	if emailApp == nil || IsTransactional(category) || len(to) == 0 {
+		return to
+	}
+	values := make([]any, len(to))
+	for i, r := range to {
+		values[i] = strings.ToLower(r.Email)
+	}
+	var rows []struct {
+		Email   string `db:"email"`
+		OptOuts string `db:"email_opt_outs"`
+	}
+	err := emailApp.DB().Select("email", "email_opt_outs").
+		From("members").
+		Where(dbx.In("LOWER(email)", values...)).
+		All(&rows)
+	if err != nil {
+		log.Default().Println(fmt.Errorf("failed to load email preferences: %w", err))
+		return to
+	}
+	optedOut := map[string]bool{}
+	for _, row := range rows {
+		var categories []string
+		if json.Unmarshal([]byte(row.OptOuts), &categories) == nil && slices.Contains(categories, category) {
+			optedOut[strings.ToLower(row.Email)] = true
+		}
+	}
+	var allowed []Recipient
+	for _, r := range to {
+		if optedOut[strings.ToLower(r.Email)] {
+			log.Default().Printf("Skipping %s, opted out of %s emails\n", r.Email, category)
+			continue
+		}
+		allowed = append(allowed, r)
+	}
+	return allowed
+}
+
+// EmailCategories lists the categories used by email_template and email_basic
+// records, excluding transactional mail which can't be opted out of.
+func EmailCategories(app core.App) []string {
+	var categories []string
+	for _, collection := range []string{"email_template", "email_basic"} {
+		var rows []struct {
+			Category string `db:"category"`
+		}
+		err := app.DB().Select("category").Distinct(true).From(collection).All(&rows)
+		if err != nil {
+			log.Default().Println(fmt.Errorf("failed to load %s categories: %w", collection, err))
+			continue
+		}
+		for _, row := range rows {
+			if !IsTransactional(row.Category) && !slices.Contains(categories, row.Category) {
+				categories = append(categories, row.Category)
+			}
+		}
+	}
+	if !slices.Contains(categories, EmailCategoryMarketing) {
+		categories = append(categories, EmailCategoryMarketing)
+	}
+	slices.Sort(categories)
+	return categories
+}
+
+// setOptOut adds or removes a category from a member's email_opt_outs.
+func setOptOut(app core.App, member *core.Record, category string, optOut bool) error {
+	var optOuts []string
+	member.UnmarshalJSONField("email_opt_outs", &optOuts)
+	has := slices.Contains(optOuts, category)
+	switch {
+	case optOut && !has:
+		optOuts = append(optOuts, category)
+	case !optOut && has:
+		optOuts = slices.DeleteFunc(optOuts, func(c string) bool { return c == category })
+	default:
+		return nil
+	}
+	member.Set("email_opt_outs", optOuts)
+	return app.Save(member)
+}
+
+// unsubscribe applies a verified unsubscribe request. Members are opted out of
+// the category; other addresses go on the suppression list for marketing.
+func unsubscribe(app core.App, claims unsubscribeClaims) error {
+	member, err := app.FindAuthRecordByEmail("members", claims.Email)
+	if err == nil {
+		return setOptOut(app, member, claims.Category, true)
+	}
+	return AddSuppression(app, claims.Email, "unsubscribed", SuppressionScopeMarketing, "unsubscribe_link")
+}
+
+// RegisterEmailPreferenceRoutes registers the one-click unsubscribe routes and
+// the member preference center.
+func RegisterEmailPreferenceRoutes(sr *router.Router[*core.RequestEvent]) {
+	// GET only shows a confirmation so link scanners can't unsubscribe anyone
+	sr.GET("/email/unsubscribe", func(e *core.RequestEvent) error {
+		token := e.Request.URL.Query().Get("token")
+		claims, err := parseUnsubscribeToken(token)
+		if err != nil {
+			return e.HTML(400, "<h1>This unsubscribe link is not valid</h1>")
+		}
+		return e.HTML(200, `<html><body style="font-family:sans-serif;text-align:center;padding:3rem;">`+
+			`<h1>Unsubscribe</h1><p>Stop sending `+html.EscapeString(claims.Category)+` emails to `+html.EscapeString(claims.Email)+`?</p>`+
+			`<p>You will still receive invoices and account emails.</p>`+
+			`<form method="POST" action="/email/unsubscribe?token=`+url.QueryEscape(token)+`">`+
+			`<button type="submit">Unsubscribe</button></form></body></html>`)
+	})
+
+	// One-click endpoint (RFC 8058) and the confirmation form both post here
+	sr.POST("/email/unsubscribe", func(e *core.RequestEvent) error {
+		claims, err := parseUnsubscribeToken(e.Request.URL.Query().Get("token"))
+		if err != nil {
+			return e.HTML(400, "<h1>This unsubscribe link is not valid</h1>")
+		}
+		if err := unsubscribe(e.App, claims); err != nil {
+			log.Default().Println(fmt.Errorf("failed to unsubscribe %s: %w", claims.Email, err))
+			return e.HTML(500, "<h1>Something went wrong, please try again later</h1>")
+		}
+		return e.HTML(200, "<h1>You have been unsubscribed</h1>")
+	})
+
+	sr.GET("/email/preferences", func(e *core.RequestEvent) error {
+		if e.Auth.Collection().Name != "members" {
+			return e.JSON(403, map[string]string{"error": "Unauthorized"})
+		}
+		var optOuts []string
+		e.Auth.UnmarshalJSONField("email_opt_outs", &optOuts)
+		preferences := map[string]bool{}
+		for _, category := range EmailCategories(e.App) {
+			preferences[category] = !slices.Contains(optOuts, category)
+		}
+		return e.JSON(200, map[string]any{"preferences": preferences})
+	}).Bind(apis.RequireAuth())
+
+	sr.POST("/email/preferences", func(e *core.RequestEvent) error {
+		if e.Auth.Collection().Name != "members" {
+			return e.JSON(403, map[string]string{"error": "Unauthorized"})
+		}
+		var data struct {
+			Preferences map[string]bool `json:"preferences"`
+		}
+		if err := e.BindBody(&data); err != nil {
+			return e.JSON(400, map[string]string{"error": "Invalid request body"})
+		}
+		categories := EmailCategories(e.App)
+		for category, subscribed := range data.Preferences {
+			if !slices.Contains(categories, category) {
+				return e.JSON(400, map[string]string{"error": "Unknown email category " + category})
+			}
+			if err := setOptOut(e.App, e.Auth, category, !subscribed); err != nil {
+				return e.JSON(500, map[string]string{"error": "Failed to save preferences"})
+			}
+		}
+		return e.JSON(200, map[string]string{"status": "success"})
+	}).Bind(apis.RequireAuth())
+}
@@ -0,0 +1,26 @@
+package lib
+
+import "testing"
+
+func TestUnsubscribeToken(t *testing.T) {
+	t.Setenv("UNSUBSCRIBE_SECRET", "")
+	t.Setenv("shared_secret", "")
+	if _, err := UnsubscribeToken("jane@example.com", "marketing"); err == nil {
+		t.Error("expected no token without a secret")
+	}
+
+	t.Setenv("UNSUBSCRIBE_SECRET", "test-secret")
+	token, err := UnsubscribeToken("Jane@Example.com", "marketing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := parseUnsubscribeToken(token)
+	if err != nil || claims.Email != "jane@example.com" || claims.Category != "marketing" {
+		t.Errorf("unexpected claims %+v, %v", claims, err)
+	}
+
+	t.Setenv("UNSUBSCRIBE_SECRET", "")
+	if _, err := parseUnsubscribeToken(token); err == nil {
+		t.Error("expected tokens to be refused without a secret")
+	}
+}
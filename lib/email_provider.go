@@ -0,0 +1,454 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+// EmailProvider delivers an outgoing email. The payload is always in the Brevo
+// shape (one message with per-recipient messageVersions and {{params.x}}
+// placeholders); providers without server-side personalisation render each
+// version themselves.
+type EmailProvider interface {
+	Name() string
+	Send(payload EmailData) error
+}
+
+var (
+	emailProviderMu sync.RWMutex
+	emailProvider   EmailProvider = BrevoProvider{}
+)
+
+// SetEmailProvider replaces the provider used by EmailSenderFrom.
+func SetEmailProvider(p EmailProvider) {
+	emailProviderMu.Lock()
+	defer emailProviderMu.Unlock()
+	emailProvider = p
+}
+
+// CurrentEmailProvider returns the provider used by EmailSenderFrom.
+func CurrentEmailProvider() EmailProvider {
+	emailProviderMu.RLock()
+	defer emailProviderMu.RUnlock()
+	return emailProvider
+}
+
+// InitEmailProvider picks the provider from the EMAIL_PROVIDER environment
+// variable: "brevo" (default), "smtp" or "capture". The app is also used to
+// consult the suppression list on every send.
+func InitEmailProvider(app core.App) {
+	emailApp = app
+	switch os.Getenv("EMAIL_PROVIDER") {
+	case "smtp":
+		SetEmailProvider(NewSMTPProviderFromEnv())
+	case "capture":
+		SetEmailProvider(CaptureProvider{App: app, Dir: os.Getenv("EMAIL_CAPTURE_DIR")})
+	default:
+		SetEmailProvider(BrevoProvider{})
+	}
+	fmt.Printf("Using %s email provider\n", CurrentEmailProvider().Name())
+}
+
+// BrevoProvider sends through the Brevo transactional email API. Large sends
+// are split into batches of messageVersions, see sendInBatches.
+type BrevoProvider struct{}
+
+func (BrevoProvider) Name() string { return "brevo" }
+
+func (p BrevoProvider) Send(payload EmailData) error {
+	_, err := p.SendWithResponse(payload)
+	return err
+}
+
+// SendWithResponse sends like Send and returns the Brevo response bodies, one
+// line per batch.
+func (BrevoProvider) SendWithResponse(payload EmailData) (string, error) {
+	size := brevoBatchSize()
+	if hasParamHeaders(payload.Headers) {
+		// Brevo fills in params in the content but not in headers, so each
+		// message version goes out on its own with its headers rendered here
+		size = 1
+	}
+	var mu sync.Mutex
+	var responses []string
+	err := sendInBatches(context.Background(), payload, size, func(batch EmailData) error {
+		b, err := json.Marshal(withVersionHeaders(batch))
+		if err != nil {
+			return fmt.Errorf("marshal payload: %w", err)
+		}
+		response, err := brevoPost(b)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			var apiErr *BrevoAPIError
+			if errors.As(err, &apiErr) {
+				responses = append(responses, apiErr.Body)
+			}
+			return err
+		}
+		responses = append(responses, response)
+		return nil
+	})
+	return strings.Join(responses, "\n"), err
+}
+
+// SMTPProvider sends through a plain SMTP server, one message per messageVersion.
+type SMTPProvider struct {
+	Client *mailer.SMTPClient
+}
+
+// NewSMTPProviderFromEnv configures the SMTP provider from SMTP_HOST, SMTP_PORT,
+// SMTP_USERNAME, SMTP_PASSWORD and SMTP_TLS.
+func NewSMTPProviderFromEnv() SMTPProvider {
+	port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+	if err != nil {
+		port = 587
+	}
+	return SMTPProvider{Client: &mailer.SMTPClient{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		TLS:      os.Getenv("SMTP_TLS") == "true",
+	}}
+}
+
+func (SMTPProvider) Name() string { return "smtp" }
+
+func (p SMTPProvider) Send(payload EmailData) error {
+	messages, err := RenderMessages(payload)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, m := range messages {
+		if err := p.Client.Send(m); err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", addressList(m.To), err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("smtp send failed for %d of %d messages: %s", len(failed), len(messages), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// CaptureProvider keeps messages instead of delivering them, for dev and CI.
+// Messages are written as JSON files to Dir when it is set, otherwise to the
+// captured_emails collection.
+type CaptureProvider struct {
+	App core.App
+	Dir string
+}
+
+// CapturedEmail is one rendered message kept by the CaptureProvider.
+type CapturedEmail struct {
+	ID          string            `json:"id"`
+	From        string            `json:"from"`
+	ReplyTo     string            `json:"reply_to"`
+	To          []string          `json:"to"`
+	CC          []string          `json:"cc"`
+	BCC         []string          `json:"bcc"`
+	Subject     string            `json:"subject"`
+	HTML        string            `json:"html"`
+	Text        string            `json:"text"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Attachments []string          `json:"attachments,omitempty"`
+	ScheduledAt string            `json:"scheduled_at,omitempty"`
+	Created     time.Time         `json:"created"`
+}
+
+func (CaptureProvider) Name() string { return "capture" }
+
+func (p CaptureProvider) Send(payload EmailData) error {
+	messages, err := RenderMessages(payload)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		captured := CapturedEmail{
+			ID:      security.RandomString(15),
+			From:    m.From.String(),
+			ReplyTo: payload.ReplyTo.Email,
+			To:      addressList(m.To),
+			CC:      addressList(m.Cc),
+			BCC:     addressList(m.Bcc),
+			Subject: m.Subject,
+			HTML:    m.HTML,
+			Text:    m.Text,
+			Headers: m.Headers,
+			Created: time.Now().UTC(),
+		}
+		if payload.ScheduledAt != nil {
+			captured.ScheduledAt = *payload.ScheduledAt
+		}
+		for name := range m.Attachments {
+			captured.Attachments = append(captured.Attachments, name)
+		}
+		if err := p.store(captured); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p CaptureProvider) store(captured CapturedEmail) error {
+	if p.Dir != "" {
+		if err := os.MkdirAll(p.Dir, 0o755); err != nil {
+			return fmt.Errorf("create capture dir: %w", err)
+		}
+		b, err := json.MarshalIndent(captured, "", "  ")
+		if err != nil {
+			return err
+		}
+		name := captured.Created.Format("20060102T150405.000000000") + "_" + captured.ID + ".json"
+		return os.WriteFile(filepath.Join(p.Dir, name), b, 0o644)
+	}
+	if p.App == nil {
+		return fmt.Errorf("capture provider has neither a directory nor an app")
+	}
+	collection, err := p.App.FindCollectionByNameOrId("captured_emails")
+	if err != nil {
+		return fmt.Errorf("failed to find captured_emails collection: %w", err)
+	}
+	record := core.NewRecord(collection)
+	record.Set("from", captured.From)
+	record.Set("reply_to", captured.ReplyTo)
+	record.Set("to", captured.To)
+	record.Set("cc", captured.CC)
+	record.Set("bcc", captured.BCC)
+	record.Set("subject", captured.Subject)
+	record.Set("html", captured.HTML)
+	record.Set("text", captured.Text)
+	record.Set("headers", captured.Headers)
+	record.Set("attachments", captured.Attachments)
+	record.Set("scheduled_at", captured.ScheduledAt)
+	return p.App.Save(record)
+}
+
+// List returns the most recently captured messages, newest first.
+func (p CaptureProvider) List(limit int) ([]CapturedEmail, error) {
+	var result []CapturedEmail
+	if p.Dir != "" {
+		entries, err := os.ReadDir(p.Dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return result, nil
+			}
+			return nil, err
+		}
+		for i := len(entries) - 1; i >= 0 && len(result) < limit; i-- {
+			if entries[i].IsDir() || filepath.Ext(entries[i].Name()) != ".json" {
+				continue
+			}
+			b, err := os.ReadFile(filepath.Join(p.Dir, entries[i].Name()))
+			if err != nil {
+				return nil, err
+			}
+			var captured CapturedEmail
+			if err := json.Unmarshal(b, &captured); err != nil {
+				return nil, err
+			}
+			result = append(result, captured)
+		}
+		return result, nil
+	}
+	records, err := p.App.FindRecordsByFilter("captured_emails", "", "-created", limit, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		captured := CapturedEmail{
+			ID:          r.Id,
+			From:        r.GetString("from"),
+			ReplyTo:     r.GetString("reply_to"),
+			To:          r.GetStringSlice("to"),
+			CC:          r.GetStringSlice("cc"),
+			BCC:         r.GetStringSlice("bcc"),
+			Subject:     r.GetString("subject"),
+			HTML:        r.GetString("html"),
+			Text:        r.GetString("text"),
+			Attachments: r.GetStringSlice("attachments"),
+			ScheduledAt: r.GetString("scheduled_at"),
+			Created:     r.GetDateTime("created").Time(),
+		}
+		r.UnmarshalJSONField("headers", &captured.Headers)
+		result = append(result, captured)
+	}
+	return result, nil
+}
+
+// CapturedEmailsRoute lists the messages kept by the capture provider.
+// Only staff accounts from the users collection may read them.
+func CapturedEmailsRoute(e *core.RequestEvent) error {
+	if e.Auth.Collection().Name != "users" {
+		return e.JSON(403, map[string]string{"error": "Unauthorized"})
+	}
+	capture, ok := CurrentEmailProvider().(CaptureProvider)
+	if !ok {
+		return e.JSON(404, map[string]string{"error": "Email capture is not enabled"})
+	}
+	limit := 50
+	if l, err := strconv.Atoi(e.Request.URL.Query().Get("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+	emails, err := capture.List(limit)
+	if err != nil {
+		return e.JSON(500, map[string]string{"error": "Failed to load captured emails"})
+	}
+	return e.JSON(200, map[string]any{"items": emails})
+}
+
+var brevoParamPattern = regexp.MustCompile(`\{\{\s*params\.([A-Za-z0-9_]+)\s*\}\}`)
+
+// RenderBrevoParams does the {{params.x}} substitution Brevo performs server
+// side. Unknown params are left untouched.
+func RenderBrevoParams(text string, params map[string]any) string {
+	return brevoParamPattern.ReplaceAllStringFunc(text, func(match string) string {
+		key := brevoParamPattern.FindStringSubmatch(match)[1]
+		value, ok := params[key]
+		if !ok || value == nil {
+			return match
+		}
+		return fmt.Sprintf("%v", value)
+	})
+}
+
+// RenderMessages expands a Brevo payload into one personalised mailer.Message
+// per messageVersion, for providers that deliver messages one by one.
+func RenderMessages(payload EmailData) ([]*mailer.Message, error) {
+	attachments := map[string][]byte{}
+	if payload.Attachment != nil {
+		for _, a := range *payload.Attachment {
+			content, err := attachmentContent(a)
+			if err != nil {
+				return nil, fmt.Errorf("attachment %s: %w", a.Name, err)
+			}
+			attachments[a.Name] = content
+		}
+	}
+
+	versions := payload.MessageVersions
+	if len(versions) == 0 {
+		versions = []MessageVersion{{}}
+	}
+	var messages []*mailer.Message
+	for _, v := range versions {
+		m := &mailer.Message{
+			From:    mail.Address{Name: payload.Sender.Name, Address: payload.Sender.Email},
+			Subject: RenderBrevoParams(firstNonEmpty(v.Subject, payload.Subject), v.Params),
+			HTML:    RenderBrevoParams(firstNonEmpty(v.HTMLContent, payload.HTMLContent), v.Params),
+			Text:    RenderBrevoParams(firstNonEmpty(v.TextContent, payload.TextContent), v.Params),
+			Headers: renderHeaders(payload.Headers, v.Params),
+		}
+		for _, to := range v.To {
+			m.To = append(m.To, mail.Address{Name: to.Name, Address: to.Email})
+		}
+		for _, cc := range v.CC {
+			m.Cc = append(m.Cc, contactFromMap(cc))
+		}
+		for _, bcc := range v.BCC {
+			m.Bcc = append(m.Bcc, contactFromMap(bcc))
+		}
+		if payload.ReplyTo.Email != "" {
+			m.Headers["Reply-To"] = (&mail.Address{Name: payload.ReplyTo.Name, Address: payload.ReplyTo.Email}).String()
+		}
+		if len(attachments) > 0 {
+			m.Attachments = map[string]io.Reader{}
+			for name, content := range attachments {
+				m.Attachments[name] = bytes.NewReader(content)
+			}
+		}
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
+
+// renderHeaders fills in the {{params.x}} placeholders of headers, as Brevo
+// does for a messageVersion.
+func renderHeaders(headers map[string]string, params map[string]any) map[string]string {
+	rendered := map[string]string{}
+	for key, value := range headers {
+		rendered[key] = RenderBrevoParams(value, params)
+	}
+	return rendered
+}
+
+// hasParamHeaders reports whether any header uses a {{params.x}} placeholder.
+func hasParamHeaders(headers map[string]string) bool {
+	for _, value := range headers {
+		if strings.Contains(value, "params.") {
+			return true
+		}
+	}
+	return false
+}
+
+// withVersionHeaders renders the headers of a batch that holds a single
+// message version with that version's params.
+func withVersionHeaders(batch EmailData) EmailData {
+	if len(batch.MessageVersions) != 1 || !hasParamHeaders(batch.Headers) {
+		return batch
+	}
+	batch.Headers = renderHeaders(batch.Headers, batch.MessageVersions[0].Params)
+	return batch
+}
+
+// mergeHeaders returns a new map with the headers of all maps, later maps winning.
+func mergeHeaders(headers ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, h := range headers {
+		maps.Copy(merged, h)
+	}
+	return merged
+}
+
+func attachmentContent(a BrevoAttachment) ([]byte, error) {
+	if a.Content != nil {
+		return base64.StdEncoding.DecodeString(*a.Content)
+	}
+	if a.URL == nil {
+		return nil, fmt.Errorf("attachment has neither content nor url")
+	}
+	resp, err := http.Get(*a.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("download failed with status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func contactFromMap(m map[string]any) mail.Address {
+	email, _ := m["email"].(string)
+	name, _ := m["name"].(string)
+	return mail.Address{Name: name, Address: email}
+}
+
+func addressList(addresses []mail.Address) []string {
+	result := make([]string, len(addresses))
+	for i, a := range addresses {
+		result[i] = a.String()
+	}
+	return result
+}
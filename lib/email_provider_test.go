@@ -0,0 +1,92 @@
+package lib
+
+import "testing"
+
+func TestRenderMessages(t *testing.T) {
+	payload := EmailData{
+		Sender:      Contact{Name: "NMM", Email: "info@example.com"},
+		ReplyTo:     Contact{Name: "Support", Email: "support@example.com"},
+		Subject:     "Hi {{params.first_name}}",
+		HTMLContent: "<p>Join at {{ params.join_url }} {{params.missing}}</p>",
+		Headers:     map[string]string{"List-Unsubscribe": "<{{params.join_url}}>"},
+		MessageVersions: []MessageVersion{
+			{
+				To:     []Contact{{Name: "Jane Doe", Email: "jane@example.com"}},
+				Params: map[string]any{"first_name": "Jane", "join_url": "https://z/1"},
+				CC:     []map[string]any{{"email": "boss@example.com", "name": "Boss"}},
+			},
+			{
+				To:     []Contact{{Name: "John Roe", Email: "john@example.com"}},
+				Params: map[string]any{"first_name": "John", "join_url": "https://z/2"},
+			},
+		},
+	}
+	messages, err := RenderMessages(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if messages[0].Subject != "Hi Jane" || messages[1].Subject != "Hi John" {
+		t.Errorf("unexpected subjects %q, %q", messages[0].Subject, messages[1].Subject)
+	}
+	if messages[1].HTML != "<p>Join at https://z/2 {{params.missing}}</p>" {
+		t.Errorf("unexpected html %q", messages[1].HTML)
+	}
+	if len(messages[0].Cc) != 1 || messages[0].Cc[0].Address != "boss@example.com" || len(messages[1].Cc) != 0 {
+		t.Errorf("unexpected cc %v / %v", messages[0].Cc, messages[1].Cc)
+	}
+	if messages[0].Headers["Reply-To"] == "" {
+		t.Error("expected a Reply-To header")
+	}
+	if messages[1].Headers["List-Unsubscribe"] != "<https://z/2>" {
+		t.Errorf("unexpected List-Unsubscribe %q", messages[1].Headers["List-Unsubscribe"])
+	}
+}
+
+func TestWithVersionHeaders(t *testing.T) {
+	payload := EmailData{
+		Headers: map[string]string{
+			"List-Unsubscribe":      "<{{params.unsubscribe_url}}>",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+		MessageVersions: []MessageVersion{
+			{To: []Contact{{Email: "jane@example.com"}}, Params: map[string]any{"unsubscribe_url": "https://x/u?token=1"}},
+			{To: []Contact{{Email: "john@example.com"}}, Params: map[string]any{"unsubscribe_url": "https://x/u?token=2"}},
+		},
+	}
+	if got := withVersionHeaders(payload); got.Headers["List-Unsubscribe"] != "<{{params.unsubscribe_url}}>" {
+		t.Errorf("a batch of several versions shouldn't be rendered, got %q", got.Headers["List-Unsubscribe"])
+	}
+	batches := splitMessageVersions(payload, 1)
+	for i, want := range []string{"<https://x/u?token=1>", "<https://x/u?token=2>"} {
+		got := withVersionHeaders(batches[i])
+		if got.Headers["List-Unsubscribe"] != want || got.Headers["List-Unsubscribe-Post"] != "List-Unsubscribe=One-Click" {
+			t.Errorf("batch %d: unexpected headers %v", i, got.Headers)
+		}
+	}
+	if payload.Headers["List-Unsubscribe"] != "<{{params.unsubscribe_url}}>" {
+		t.Error("the payload headers were changed")
+	}
+}
+
+func TestRenderMessagesVersionContent(t *testing.T) {
+	messages, err := RenderMessages(EmailData{
+		Subject:     "Meeting",
+		HTMLContent: "<p>Hi</p>",
+		MessageVersions: []MessageVersion{
+			{To: []Contact{{Email: "jane@example.com"}}, Subject: "Meeting for Jane", HTMLContent: "<p>Hi Jane</p>"},
+			{To: []Contact{{Email: "john@example.com"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages[0].Subject != "Meeting for Jane" || messages[0].HTML != "<p>Hi Jane</p>" {
+		t.Errorf("version content not used: %q %q", messages[0].Subject, messages[0].HTML)
+	}
+	if messages[1].Subject != "Meeting" || messages[1].HTML != "<p>Hi</p>" {
+		t.Errorf("payload content not used: %q %q", messages[1].Subject, messages[1].HTML)
+	}
+}
@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// AgingBucketNames are the receivables aging buckets in display order.
+var AgingBucketNames = []string{"current", "1-30", "31-60", "61-90", "90+"}
+
+// FinanceInvoice is the subset of an invoice the dashboard needs.
+type FinanceInvoice struct {
+	Amount   float64
+	DueDate  time.Time
+	Paid     bool
+	PaidDate time.Time
+	PaidVia  string
+}
+
+// FinanceTotal is an amount with the number of invoices that make it up.
+type FinanceTotal struct {
+	Count  int     `json:"count"`
+	Amount float64 `json:"amount"`
+}
+
+func (t *FinanceTotal) add(amount float64) {
+	t.Count++
+	t.Amount += amount
+}
+
+// MonthlyCollected is what was collected in a calendar month (YYYY-MM).
+type MonthlyCollected struct {
+	Month   string       `json:"month"`
+	Total   FinanceTotal `json:"total"`
+	Autopay FinanceTotal `json:"autopay"`
+	Manual  FinanceTotal `json:"manual"`
+}
+
+// AutopayStats summarises the autopay charge attempts recorded by the Stripe
+// webhook in autopay_attempts, so every retry of an invoice counts.
+type AutopayStats struct {
+	Succeeded   int     `json:"succeeded"`
+	Failed      int     `json:"failed"`
+	SuccessRate float64 `json:"success_rate"`
+}
+
+// FinanceSummary is the response of the finance dashboard route.
+type FinanceSummary struct {
+	Aging     map[string]FinanceTotal `json:"aging"`
+	Collected []MonthlyCollected      `json:"collected"`
+	Autopay   AutopayStats            `json:"autopay"`
+}
+
+// agingBucket returns the aging bucket for an invoice that is daysPastDue days
+// past its due date. Invoices not yet due, or due today, are current.
+func agingBucket(daysPastDue int) string {
+	switch {
+	case daysPastDue <= 0:
+		return "current"
+	case daysPastDue <= 30:
+		return "1-30"
+	case daysPastDue <= 60:
+		return "31-60"
+	case daysPastDue <= 90:
+		return "61-90"
+	default:
+		return "90+"
+	}
+}
+
+// isAutopay reports whether a paid invoice was collected by an autopay charge,
+// as recorded in paid_via from the PaymentIntent's autopay metadata. An autopay
+// invoice the member paid by hand is manual.
+func (i FinanceInvoice) isAutopay() bool {
+	return i.PaidVia == "autopay"
+}
+
+// ComputeFinanceSummary builds the aging report for unpaid invoices, the
+// collected totals for the months that start at or after since, and the
+// success rate of the autopay attempts given, each a payment status.
+func ComputeFinanceSummary(invoices []FinanceInvoice, autopayAttempts []string, now, since time.Time) FinanceSummary {
+	summary := FinanceSummary{Aging: map[string]FinanceTotal{}}
+	for _, name := range AgingBucketNames {
+		summary.Aging[name] = FinanceTotal{}
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	months := map[string]*MonthlyCollected{}
+	for m := time.Date(since.Year(), since.Month(), 1, 0, 0, 0, 0, time.UTC); !m.After(today); m = m.AddDate(0, 1, 0) {
+		key := m.Format("2006-01")
+		months[key] = &MonthlyCollected{Month: key}
+		summary.Collected = append(summary.Collected, MonthlyCollected{Month: key})
+	}
+
+	for _, status := range autopayAttempts {
+		switch status {
+		case "succeeded":
+			summary.Autopay.Succeeded++
+		case "failed":
+			summary.Autopay.Failed++
+		}
+	}
+
+	for _, inv := range invoices {
+		if !inv.Paid {
+			due := time.Date(inv.DueDate.Year(), inv.DueDate.Month(), inv.DueDate.Day(), 0, 0, 0, 0, time.UTC)
+			bucket := agingBucket(int(today.Sub(due).Hours() / 24))
+			total := summary.Aging[bucket]
+			total.add(inv.Amount)
+			summary.Aging[bucket] = total
+			continue
+		}
+
+		month, ok := months[inv.PaidDate.UTC().Format("2006-01")]
+		if !ok {
+			continue
+		}
+		month.Total.add(inv.Amount)
+		if inv.isAutopay() {
+			month.Autopay.add(inv.Amount)
+		} else {
+			month.Manual.add(inv.Amount)
+		}
+	}
+
+	for i, m := range summary.Collected {
+		summary.Collected[i] = *months[m.Month]
+	}
+	if attempts := summary.Autopay.Succeeded + summary.Autopay.Failed; attempts > 0 {
+		summary.Autopay.SuccessRate = float64(summary.Autopay.Succeeded) / float64(attempts)
+	}
+	return summary
+}
+
+// FinanceDashboardRoute returns receivables aging, monthly collections and the
+// autopay success rate. ?months= controls how many months of collections are
+// returned (default 12). Only staff accounts from the users collection may call it.
+func FinanceDashboardRoute(e *core.RequestEvent) error {
+	if e.Auth.Collection().Name != "users" {
+		return e.JSON(403, map[string]string{"error": "Unauthorized"})
+	}
+	months := 12
+	if m := e.Request.URL.Query().Get("months"); m != "" {
+		n, err := strconv.Atoi(m)
+		if err != nil || n < 1 || n > 60 {
+			return e.JSON(400, map[string]string{"error": "months must be between 1 and 60"})
+		}
+		months = n
+	}
+
+	now := time.Now().UTC()
+	since := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1-months, 0)
+	records, err := e.App.FindRecordsByFilter(
+		"invoices",
+		"paid = false || paid_date >= {:since}",
+		"",
+		0,
+		0,
+		dbx.Params{"since": since.Format("2006-01-02 15:04:05")},
+	)
+	if err != nil {
+		return e.JSON(500, map[string]string{"error": "Failed to load invoices"})
+	}
+
+	invoices := make([]FinanceInvoice, 0, len(records))
+	for _, r := range records {
+		invoices = append(invoices, FinanceInvoice{
+			Amount:   float64(invoiceAmountCents(r)) / 100,
+			DueDate:  r.GetDateTime("duedate").Time(),
+			Paid:     r.GetBool("paid"),
+			PaidDate: r.GetDateTime("paid_date").Time(),
+			PaidVia:  r.GetString("paid_via"),
+		})
+	}
+	attemptRecords, err := e.App.FindRecordsByFilter(
+		"autopay_attempts",
+		"created >= {:since}",
+		"",
+		0,
+		0,
+		dbx.Params{"since": since.Format("2006-01-02 15:04:05")},
+	)
+	if err != nil {
+		return e.JSON(500, map[string]string{"error": "Failed to load autopay attempts"})
+	}
+	attempts := make([]string, 0, len(attemptRecords))
+	for _, r := range attemptRecords {
+		attempts = append(attempts, r.GetString("status"))
+	}
+	return e.JSON(200, ComputeFinanceSummary(invoices, attempts, now, since))
+}
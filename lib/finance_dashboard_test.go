@@ -0,0 +1,47 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeFinanceSummary(t *testing.T) {
+	now := time.Date(2026, 6, 15, 12, 0, 0, 0, time.UTC)
+	since := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	invoices := []FinanceInvoice{
+		{Amount: 100, DueDate: now},
+		{Amount: 50, DueDate: now.AddDate(0, 0, -1)},
+		{Amount: 75, DueDate: now.AddDate(0, 0, -45)},
+		{Amount: 20, DueDate: now.AddDate(0, 0, -200)},
+		{Amount: 300, Paid: true, PaidDate: time.Date(2026, 5, 3, 0, 0, 0, 0, time.UTC), PaidVia: "autopay"},
+		{Amount: 200, Paid: true, PaidDate: time.Date(2026, 6, 2, 0, 0, 0, 0, time.UTC), PaidVia: "manual"},
+		{Amount: 10, Paid: true, PaidDate: time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{Amount: 90, DueDate: now.AddDate(0, 0, -3)},
+	}
+	// the 300 invoice failed twice before it went through
+	attempts := []string{"failed", "failed", "succeeded", "failed"}
+	s := ComputeFinanceSummary(invoices, attempts, now, since)
+
+	want := map[string]FinanceTotal{
+		"current": {Count: 1, Amount: 100},
+		"1-30":    {Count: 2, Amount: 140},
+		"31-60":   {Count: 1, Amount: 75},
+		"61-90":   {},
+		"90+":     {Count: 1, Amount: 20},
+	}
+	for name, w := range want {
+		if s.Aging[name] != w {
+			t.Errorf("bucket %s: got %+v, want %+v", name, s.Aging[name], w)
+		}
+	}
+
+	if len(s.Collected) != 2 || s.Collected[0].Month != "2026-05" || s.Collected[1].Month != "2026-06" {
+		t.Fatalf("unexpected months: %+v", s.Collected)
+	}
+	if s.Collected[0].Autopay.Amount != 300 || s.Collected[1].Manual.Amount != 200 {
+		t.Errorf("unexpected autopay/manual split: %+v", s.Collected)
+	}
+	if s.Autopay.Succeeded != 1 || s.Autopay.Failed != 3 || s.Autopay.SuccessRate != 0.25 {
+		t.Errorf("unexpected autopay stats: %+v", s.Autopay)
+	}
+}
@@ -30,6 +30,7 @@ type Invoice struct {
 	SessionURL    string                `db:"sessionurl" mapstructure:"sessionurl"`
 	DaysRemaining int                   `db:"days_remaining" mapstructure:"days_remaining"`
 	Members       string                `db:"members" mapstructure:"members"`
+	LateFee       float64               `db:"late_fee" mapstructure:"late_fee"`
 }
 
 var InvoiceKeys = []string{
@@ -47,9 +48,11 @@ type EmailTemplate struct {
 	Subject string `db:"subject"`
 	Body    string `db:"html"`
 	Days    int    `db:"days"`
+	Layout  string `db:"layout"`
 }
 
 func CheckInvoice(app *pocketbase.PocketBase) {
+	ApplyLateFees(app)
 	var res []Invoice
 	err := app.DB().Select(
 		"*, CAST(julianday(date(duedate)) - julianday(date('now')) as INTEGER) as days_remaining",
@@ -66,6 +69,7 @@ func CheckInvoice(app *pocketbase.PocketBase) {
 		return
 	}
 	templates := getEmailTemplates(app.DB())
+	engine := LoadTemplateEngine(app)
 	for _, invoice := range res {
 		//check if the invoice has a member associated with it, if it does we need to grab the member
 		hasMember := invoice.Members != ""
@@ -128,8 +132,12 @@ func CheckInvoice(app *pocketbase.PocketBase) {
 				log.Default().Println(err)
 			}
 		} else if invoice.Reminders {
-			message := sendReminderEmail(invoice, templates[invoice.DaysRemaining], memberTo, memberCC)
-			err := app.NewMailClient().Send(message)
+			message, err := sendReminderEmail(engine, invoice, templates[invoice.DaysRemaining], memberTo, memberCC)
+			if err != nil {
+				log.Default().Println(err)
+				continue
+			}
+			err = app.NewMailClient().Send(message)
 			if err != nil {
 				log.Default().Println(err)
 			}
@@ -139,12 +147,14 @@ func CheckInvoice(app *pocketbase.PocketBase) {
 	}
 }
 
-func sendReminderEmail(invoice Invoice, template EmailTemplate, to mail.Address, cc []mail.Address) *mailer.Message {
-	messageText := paramsCleanUp(template.Body, invoice)
-	if invoice.InvoiceType == "auto" {
-		messageText = strings.ReplaceAll(messageText, "{{params.is_auto_pay}}", "<bold>Note:</bold> This invoice will be automatically billed to your card on the due date.<br>")
-	} else {
-		messageText = strings.ReplaceAll(messageText, "{{params.is_auto_pay}}", "")
+func sendReminderEmail(engine *TemplateEngine, invoice Invoice, template EmailTemplate, to mail.Address, cc []mail.Address) (*mailer.Message, error) {
+	rendered, err := engine.Render(MessageTemplate{
+		Subject: template.Subject,
+		Body:    template.Body,
+		Layout:  template.Layout,
+	}, invoiceTemplateData(invoice), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render reminder for invoice %s: %w", invoice.ID, err)
 	}
 	//
 	if to.Address == "" && invoice.Email != "" {
@@ -158,10 +168,11 @@ func sendReminderEmail(invoice Invoice, template EmailTemplate, to mail.Address,
 		},
 		To:      []mail.Address{to},
 		Cc:      cc,
-		Subject: paramsCleanUp(template.Subject, invoice),
-		HTML:    messageText,
+		Subject: rendered.Subject,
+		HTML:    rendered.HTML,
+		Text:    rendered.Text,
 	}
-	return message
+	return message, nil
 }
 
 func getEmailTemplates(db dbx.Builder) map[int]EmailTemplate {
@@ -174,18 +185,25 @@ func getEmailTemplates(db dbx.Builder) map[int]EmailTemplate {
 	return templates
 }
 
-func paramsCleanUp(Text string, invoice Invoice) string {
+// invoiceTemplateData is the template data for an invoice reminder.
+func invoiceTemplateData(invoice Invoice) map[string]any {
+	data := map[string]any{}
 	v := reflect.ValueOf(invoice)
 	for _, key := range InvoiceKeys {
 		field := v.FieldByName(key)
 		if field.IsValid() && field.Kind() == reflect.String {
-			Text = strings.ReplaceAll(Text, "{{params."+key+"}}", field.String())
+			data[key] = field.String()
 		}
 	}
-	first_name := strings.Split(invoice.Name, " ")[0]
-	Text = strings.ReplaceAll(Text, "{{params.first_name}}", first_name)
-	Text = strings.ReplaceAll(Text, "{{params.DueDate}}", convertTimeToString(invoice.DueDate))
-	return Text
+	data["first_name"] = strings.Split(invoice.Name, " ")[0]
+	data["Amount"] = fmt.Sprintf("%.2f", invoice.Amount)
+	data["DueDate"] = convertTimeToString(invoice.DueDate)
+	data["LateFee"] = fmt.Sprintf("%.2f", invoice.LateFee)
+	data["is_auto_pay"] = ""
+	if invoice.InvoiceType == "auto" {
+		data["is_auto_pay"] = "<bold>Note:</bold> This invoice will be automatically billed to your card on the due date.<br>"
+	}
+	return data
 }
 
 func convertTimeToString(t types.DateTime) string {
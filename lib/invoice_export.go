@@ -0,0 +1,279 @@
+package lib
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/spf13/cobra"
+	"github.com/stripe/stripe-go/v81"
+	"github.com/stripe/stripe-go/v81/checkout/session"
+	"github.com/stripe/stripe-go/v81/paymentintent"
+)
+
+// PaidInvoiceRow is a single paid invoice as handed to the bookkeeper.
+// Fee and Net come from the Stripe balance transaction and are zero when the
+// invoice was paid outside Stripe.
+type PaidInvoiceRow struct {
+	PaidDate        time.Time
+	Amount          float64
+	InvoiceName     string
+	Member          string
+	Company         string
+	PaymentIntentID string
+	Fee             float64
+	Net             float64
+}
+
+var exportCSVHeader = []string{"paid_date", "amount", "invoice", "member", "company", "payment_intent", "fee", "net"}
+
+// FetchPaidInvoices returns the invoices paid in [from, to) with their Stripe fees.
+func FetchPaidInvoices(app core.App, from, to time.Time) ([]PaidInvoiceRow, error) {
+	records, err := app.FindRecordsByFilter(
+		"invoices",
+		"paid = true && paid_date >= {:from} && paid_date < {:to}",
+		"paid_date",
+		0,
+		0,
+		dbx.Params{"from": from.UTC().Format("2006-01-02 15:04:05"), "to": to.UTC().Format("2006-01-02 15:04:05")},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch paid invoices: %w", err)
+	}
+	errs := app.ExpandRecords(records, []string{"members"}, nil)
+	if len(errs) > 0 {
+		log.Default().Printf("failed to expand invoice members: %v\n", errs)
+	}
+
+	rows := make([]PaidInvoiceRow, 0, len(records))
+	for _, record := range records {
+		row := PaidInvoiceRow{
+			PaidDate:    record.GetDateTime("paid_date").Time(),
+			Amount:      float64(invoiceAmountCents(record)) / 100,
+			InvoiceName: record.GetString("invoicename"),
+			Member:      record.GetString("name"),
+		}
+		if members := record.ExpandedAll("members"); len(members) > 0 {
+			row.Member = strings.TrimSpace(members[0].GetString("first_name") + " " + members[0].GetString("last_name"))
+			row.Company = members[0].GetString("company")
+		}
+		row.Net = row.Amount
+		if sessionID := record.GetString("session"); sessionID != "" {
+			piID, fee, net, err := stripeBalanceDetails(sessionID)
+			if err != nil {
+				log.Default().Printf("failed to load balance transaction for invoice %s: %v\n", record.Id, err)
+			} else {
+				row.PaymentIntentID = piID
+				row.Fee = float64(fee) / 100
+				row.Net = float64(net) / 100
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// stripeBalanceDetails resolves a stored session (PaymentIntent or Checkout
+// session id) to its PaymentIntent id and the fee and net of its charge, in cents.
+func stripeBalanceDetails(sessionID string) (string, int64, int64, error) {
+	var pi *stripe.PaymentIntent
+	switch {
+	case strings.HasPrefix(sessionID, "pi_"):
+		params := &stripe.PaymentIntentParams{}
+		params.AddExpand("latest_charge.balance_transaction")
+		var err error
+		pi, err = paymentintent.Get(sessionID, params)
+		if err != nil {
+			return "", 0, 0, err
+		}
+	case strings.HasPrefix(sessionID, "cs_"):
+		params := &stripe.CheckoutSessionParams{}
+		params.AddExpand("payment_intent.latest_charge.balance_transaction")
+		cs, err := session.Get(sessionID, params)
+		if err != nil {
+			return "", 0, 0, err
+		}
+		pi = cs.PaymentIntent
+	}
+	if pi == nil {
+		return "", 0, 0, fmt.Errorf("no payment intent found for %s", sessionID)
+	}
+	if pi.LatestCharge == nil || pi.LatestCharge.BalanceTransaction == nil {
+		return pi.ID, 0, pi.AmountReceived, nil
+	}
+	bt := pi.LatestCharge.BalanceTransaction
+	return pi.ID, bt.Fee, bt.Net, nil
+}
+
+// WriteInvoicesCSV writes the rows as CSV with a header line.
+func WriteInvoicesCSV(w io.Writer, rows []PaidInvoiceRow) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(exportCSVHeader); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		err := cw.Write([]string{
+			r.PaidDate.Format("2006-01-02"),
+			formatMoney(r.Amount),
+			r.InvoiceName,
+			r.Member,
+			r.Company,
+			r.PaymentIntentID,
+			formatMoney(r.Fee),
+			formatMoney(r.Net),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteInvoicesIIF writes the rows as QuickBooks IIF deposits. Each deposit puts
+// the net amount into the bank account and splits it into the gross income and
+// the Stripe fee, so every transaction balances to zero. Account names can be
+// overridden with ACCOUNTING_BANK_ACCOUNT, ACCOUNTING_INCOME_ACCOUNT and
+// ACCOUNTING_FEE_ACCOUNT.
+func WriteInvoicesIIF(w io.Writer, rows []PaidInvoiceRow) error {
+	bank := firstNonEmpty(os.Getenv("ACCOUNTING_BANK_ACCOUNT"), "Stripe")
+	income := firstNonEmpty(os.Getenv("ACCOUNTING_INCOME_ACCOUNT"), "Membership Income")
+	fees := firstNonEmpty(os.Getenv("ACCOUNTING_FEE_ACCOUNT"), "Merchant Fees")
+
+	var b strings.Builder
+	b.WriteString("!TRNS\tTRNSTYPE\tDATE\tACCNT\tNAME\tAMOUNT\tMEMO\tDOCNUM\n")
+	b.WriteString("!SPL\tTRNSTYPE\tDATE\tACCNT\tNAME\tAMOUNT\tMEMO\tDOCNUM\n")
+	b.WriteString("!ENDTRNS\n")
+	for _, r := range rows {
+		date := r.PaidDate.Format("01/02/2006")
+		name := iifField(firstNonEmpty(r.Company, r.Member))
+		memo := iifField(r.InvoiceName)
+		doc := iifField(r.PaymentIntentID)
+		fmt.Fprintf(&b, "TRNS\tDEPOSIT\t%s\t%s\t%s\t%s\t%s\t%s\n", date, bank, name, formatMoney(r.Net), memo, doc)
+		fmt.Fprintf(&b, "SPL\tDEPOSIT\t%s\t%s\t%s\t%s\t%s\t%s\n", date, income, name, formatMoney(-r.Amount), memo, doc)
+		if r.Fee != 0 {
+			fmt.Fprintf(&b, "SPL\tDEPOSIT\t%s\t%s\t%s\t%s\t%s\t%s\n", date, fees, name, formatMoney(r.Fee), memo, doc)
+		}
+		b.WriteString("ENDTRNS\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// iifField strips the characters that would break an IIF line.
+func iifField(s string) string {
+	return strings.NewReplacer("\t", " ", "\n", " ", "\r", " ", "\"", "").Replace(s)
+}
+
+func formatMoney(v float64) string {
+	return fmt.Sprintf("%.2f", v)
+}
+
+// parseExportRange parses from/to dates (YYYY-MM-DD, inclusive) into a half-open
+// range. Missing values default to the current month.
+func parseExportRange(fromStr, toStr string) (time.Time, time.Time, error) {
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	if fromStr != "" {
+		t, err := time.Parse("2006-01-02", fromStr)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid from date: %w", err)
+		}
+		from = t
+	}
+	if toStr != "" {
+		t, err := time.Parse("2006-01-02", toStr)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid to date: %w", err)
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+	if !to.After(from) {
+		return from, to, fmt.Errorf("to must not be before from")
+	}
+	return from, to, nil
+}
+
+func writeInvoiceExport(w io.Writer, format string, rows []PaidInvoiceRow) error {
+	switch format {
+	case "", "csv":
+		return WriteInvoicesCSV(w, rows)
+	case "iif":
+		return WriteInvoicesIIF(w, rows)
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// InvoiceExportRoute streams paid invoices for ?from=&to= as CSV or IIF (?format=iif).
+// Only staff accounts from the users collection may export.
+func InvoiceExportRoute(e *core.RequestEvent) error {
+	if e.Auth.Collection().Name != "users" {
+		return e.JSON(403, map[string]string{"error": "Unauthorized"})
+	}
+	query := e.Request.URL.Query()
+	format := query.Get("format")
+	if format != "" && format != "csv" && format != "iif" {
+		return e.JSON(400, map[string]string{"error": "format must be csv or iif"})
+	}
+	from, to, err := parseExportRange(query.Get("from"), query.Get("to"))
+	if err != nil {
+		return e.JSON(400, map[string]string{"error": err.Error()})
+	}
+	rows, err := FetchPaidInvoices(e.App, from, to)
+	if err != nil {
+		return e.JSON(500, map[string]string{"error": "Failed to load paid invoices"})
+	}
+
+	ext, contentType := "csv", "text/csv"
+	if format == "iif" {
+		ext, contentType = "iif", "text/plain"
+	}
+	filename := fmt.Sprintf("invoices_%s_%s.%s", from.Format("20060102"), to.AddDate(0, 0, -1).Format("20060102"), ext)
+	e.Response.Header().Set("Content-Type", contentType)
+	e.Response.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	e.Response.WriteHeader(200)
+	return writeInvoiceExport(e.Response, format, rows)
+}
+
+// NewInvoiceExportCommand returns the export-invoices console command, which
+// writes the same export as InvoiceExportRoute to stdout or a file.
+func NewInvoiceExportCommand(app core.App) *cobra.Command {
+	var fromStr, toStr, format, out string
+	cmd := &cobra.Command{
+		Use:   "export-invoices",
+		Short: "Export paid invoices as CSV or QuickBooks IIF",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			from, to, err := parseExportRange(fromStr, toStr)
+			if err != nil {
+				return err
+			}
+			rows, err := FetchPaidInvoices(app, from, to)
+			if err != nil {
+				return err
+			}
+			w := cmd.OutOrStdout()
+			if out != "" {
+				f, err := os.Create(out)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				w = f
+			}
+			return writeInvoiceExport(w, format, rows)
+		},
+	}
+	cmd.Flags().StringVar(&fromStr, "from", "", "first paid date to include (YYYY-MM-DD), defaults to the start of this month")
+	cmd.Flags().StringVar(&toStr, "to", "", "last paid date to include (YYYY-MM-DD), defaults to the end of this month")
+	cmd.Flags().StringVar(&format, "format", "csv", "csv or iif")
+	cmd.Flags().StringVar(&out, "out", "", "output file, defaults to stdout")
+	return cmd
+}
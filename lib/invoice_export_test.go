@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func TestWriteInvoicesIIFBalances(t *testing.T) {
+	rows := []PaidInvoiceRow{
+		{
+			PaidDate:        time.Date(2026, 3, 4, 15, 0, 0, 0, time.UTC),
+			Amount:          250,
+			InvoiceName:     "March dues",
+			Member:          "Jane Doe",
+			Company:         "Doe\tCo",
+			PaymentIntentID: "pi_123",
+			Fee:             7.55,
+			Net:             242.45,
+		},
+		{
+			PaidDate:    time.Date(2026, 3, 5, 15, 0, 0, 0, time.UTC),
+			Amount:      100,
+			InvoiceName: "Check payment",
+			Member:      "John Roe",
+			Net:         100,
+		},
+	}
+	var buf bytes.Buffer
+	if err := WriteInvoicesIIF(&buf, rows); err != nil {
+		t.Fatal(err)
+	}
+
+	var sum float64
+	transactions := 0
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		fields := strings.Split(line, "\t")
+		switch fields[0] {
+		case "TRNS", "SPL":
+			if len(fields) != 8 {
+				t.Fatalf("expected 8 fields, got %d in %q", len(fields), line)
+			}
+			amount, err := strconv.ParseFloat(fields[5], 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum += amount
+		case "ENDTRNS":
+			transactions++
+			if sum > 0.001 || sum < -0.001 {
+				t.Fatalf("transaction %d does not balance: %.2f", transactions, sum)
+			}
+			sum = 0
+		}
+	}
+	if transactions != len(rows) {
+		t.Fatalf("expected %d transactions, got %d", len(rows), transactions)
+	}
+}
+
+func TestParseExportRange(t *testing.T) {
+	from, to, err := parseExportRange("2026-01-01", "2026-01-31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !from.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) || !to.Equal(time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected range %v - %v", from, to)
+	}
+	if _, _, err := parseExportRange("2026-02-01", "2026-01-01"); err == nil {
+		t.Fatal("expected an error for a reversed range")
+	}
+}
+
+func TestInvoiceAmountCents(t *testing.T) {
+	record := core.NewRecord(core.NewBaseCollection("invoices"))
+	for _, amount := range []any{19.99, "19.99"} {
+		record.Set("amount", amount)
+		if got := invoiceAmountCents(record); got != 1999 {
+			t.Errorf("amount %v: got %d cents, want 1999", amount, got)
+		}
+	}
+}
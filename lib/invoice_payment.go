@@ -0,0 +1,204 @@
+package lib
+
+import (
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/stripe/stripe-go/v81"
+	"github.com/stripe/stripe-go/v81/customer"
+	"github.com/stripe/stripe-go/v81/paymentintent"
+)
+
+const (
+	defaultSuccessURL = "https://nextmilmastermind.com/thank-you"
+	defaultCancelURL  = "https://nextmilmastermind.com"
+)
+
+// InvoicePaymentRequest is the body accepted by InvoicePaymentRoute.
+// UI is either "checkout" (embedded Checkout) or "element" (Payment Element).
+type InvoicePaymentRequest struct {
+	UI string `json:"ui"`
+}
+
+// InvoicePaymentRoute returns a client secret that lets the member portal take
+// payment for an invoice without redirecting away, either through embedded
+// Checkout or through a PaymentIntent for the Payment Element.
+func InvoicePaymentRoute(e *core.RequestEvent) error {
+	invoiceID := e.Request.PathValue("invoiceID")
+	var data InvoicePaymentRequest
+	if err := e.BindBody(&data); err != nil {
+		return e.JSON(400, map[string]string{"error": "Invalid request body"})
+	}
+	if data.UI == "" {
+		data.UI = "checkout"
+	}
+	if data.UI != "checkout" && data.UI != "element" {
+		return e.JSON(400, map[string]string{"error": "ui must be either checkout or element"})
+	}
+
+	record, err := e.App.FindRecordById("invoices", invoiceID)
+	if err != nil {
+		return e.JSON(404, map[string]string{"error": "Invoice not found"})
+	}
+	if record.GetBool("paid") {
+		return e.JSON(409, map[string]string{"error": "Invoice has already been paid"})
+	}
+	// a charge still in progress, like an autopay waiting on the bank or on
+	// 3D Secure, would be lost if the session was replaced
+	active, err := hasActiveCharge(record.GetString("session"))
+	if err != nil {
+		log.Printf("Error checking invoice payment: %v", err)
+		return e.JSON(500, map[string]string{"error": "Failed to check invoice payment"})
+	}
+	if active {
+		return e.JSON(409, map[string]string{"error": "Invoice already has a pending or successful payment"})
+	}
+	errs := e.App.ExpandRecord(record, []string{"members"}, nil)
+	if errs != nil {
+		log.Printf("Error expanding record: %v", errs)
+	}
+
+	response := map[string]any{"status": "success", "ui": data.UI}
+	if data.UI == "element" {
+		pi, err := generatePaymentIntent(record)
+		if err != nil {
+			log.Printf("Error generating payment intent: %v", err)
+			return e.JSON(500, map[string]string{"error": "Failed to generate payment intent"})
+		}
+		record.Set("session", pi.ID)
+		response["clientsecret"] = pi.ClientSecret
+	} else {
+		paySession, err := generateSession(record, true)
+		if err != nil {
+			log.Printf("Error generating session: %v", err)
+			return e.JSON(500, map[string]string{"error": "Failed to generate payment session"})
+		}
+		record.Set("session", paySession.ID)
+		response["clientsecret"] = paySession.ClientSecret
+	}
+	// the hosted session url no longer matches the stored session
+	record.Set("session_url", "")
+	if err := e.App.Save(record); err != nil {
+		log.Printf("Error saving invoice record: %v", err)
+		return e.JSON(500, map[string]string{"error": "Failed to save invoice session"})
+	}
+	return e.JSON(200, response)
+}
+
+// generatePaymentIntent creates a PaymentIntent for the Payment Element. An
+// unconfirmed PaymentIntent already stored on the invoice is reused so repeated
+// page loads don't leave a trail of abandoned intents.
+func generatePaymentIntent(invoice *core.Record) (*stripe.PaymentIntent, error) {
+	amount := invoiceAmountCents(invoice)
+	if existing := invoice.GetString("session"); strings.HasPrefix(existing, "pi_") {
+		pi, err := paymentintent.Get(existing, nil)
+		if err == nil && pi.Amount == amount &&
+			(pi.Status == stripe.PaymentIntentStatusRequiresPaymentMethod ||
+				pi.Status == stripe.PaymentIntentStatusRequiresConfirmation) {
+			return pi, nil
+		}
+	}
+
+	email, name := invoiceBillingContact(invoice)
+	cust, err := findOrCreateCustomer(email, name)
+	if err != nil {
+		return nil, err
+	}
+	piParams := &stripe.PaymentIntentParams{
+		Amount:       stripe.Int64(amount),
+		Currency:     stripe.String("usd"),
+		Customer:     stripe.String(cust.ID),
+		ReceiptEmail: stripe.String(email),
+		Description:  stripe.String(invoice.GetString("invoicename")),
+		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
+			Enabled: stripe.Bool(true),
+		},
+	}
+	// Same rule as the Checkout flow: non standard invoices keep the card for autopay.
+	if invoiceType := invoice.GetString("type"); invoiceType != "" && invoiceType != "standard" {
+		piParams.SetupFutureUsage = stripe.String("off_session")
+	}
+	piParams.AddMetadata("type", "invoice")
+	piParams.AddMetadata("invoice_id", invoice.Id)
+	return paymentintent.New(piParams)
+}
+
+// invoiceBillingContact returns the email and name to bill, preferring the first
+// expanded member over the name and email stored on the invoice.
+func invoiceBillingContact(invoice *core.Record) (string, string) {
+	email := invoice.GetString("email")
+	name := invoice.GetString("name")
+
+	// Try to get expanded members - they may already be expanded
+	allMembers := invoice.ExpandedAll("members")
+	if len(allMembers) > 0 {
+		firstMember := allMembers[0]
+		memberName := firstMember.GetString("first_name") + " " + firstMember.GetString("last_name")
+		memberEmail := firstMember.GetString("email")
+		if memberEmail != "" {
+			email = memberEmail
+			name = memberName
+		}
+	}
+	return email, name
+}
+
+// findOrCreateCustomer looks up a Stripe customer by email and creates one if
+// none exists.
+func findOrCreateCustomer(email, name string) (*stripe.Customer, error) {
+	custParams := &stripe.CustomerListParams{
+		Email: stripe.String(email),
+	}
+	custParams.Limit = stripe.Int64(1)
+	ci := customer.List(custParams)
+	if ci.Next() {
+		return ci.Customer(), nil
+	}
+	createParams := &stripe.CustomerParams{
+		Email: stripe.String(email),
+		Name:  stripe.String(name),
+	}
+	cust, err := customer.New(createParams)
+	if err != nil {
+		log.Printf("Error creating customer: %v", err)
+		return nil, err
+	}
+	return cust, nil
+}
+
+// invoiceAmountCents converts the invoice amount to cents.
+// Assumes invoice["amount"] is either string or a float64.
+func invoiceAmountCents(invoice *core.Record) int64 {
+	switch v := invoice.Get("amount").(type) {
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return int64(math.Round(f * 100))
+		}
+	case float64:
+		return int64(math.Round(v * 100))
+	}
+	return 0
+}
+
+// invoiceRedirectURLs returns the success and cancel URLs for an invoice.
+// The success_url and cancel_url fields on the invoice win, then the
+// STRIPE_SUCCESS_URL and STRIPE_CANCEL_URL environment variables, then the
+// public site.
+func invoiceRedirectURLs(invoice *core.Record) (string, string) {
+	successURL := firstNonEmpty(invoice.GetString("success_url"), os.Getenv("STRIPE_SUCCESS_URL"), defaultSuccessURL)
+	cancelURL := firstNonEmpty(invoice.GetString("cancel_url"), os.Getenv("STRIPE_CANCEL_URL"), defaultCancelURL)
+	return successURL, cancelURL
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
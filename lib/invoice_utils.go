@@ -1,12 +1,15 @@
 package lib
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"strconv"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/mitchellh/mapstructure"
+	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/stripe/stripe-go/v81"
@@ -22,8 +25,20 @@ type SavedCard struct {
 	Last_4    string `db:"last_4"`
 }
 
+// ErrChargeExists is returned by createStripeCharge when the invoice already has
+// a PaymentIntent that is pending or has succeeded.
+var ErrChargeExists = errors.New("invoice already has an active payment")
+
 func createStripeCharge(invoice Invoice, app *pocketbase.PocketBase) (bool, error) {
 	email := invoice.Email
+	//make sure we never charge an invoice that already has a pending or successful payment
+	active, err := hasActiveCharge(invoice.Session)
+	if err != nil {
+		return false, err
+	}
+	if active {
+		return false, fmt.Errorf("invoice %s: %w", invoice.ID, ErrChargeExists)
+	}
 	//check stored cards to see if the email is in there
 	card, err := grab_card(email)
 	if err != nil {
@@ -40,7 +55,8 @@ func createStripeCharge(invoice Invoice, app *pocketbase.PocketBase) (bool, erro
 	}
 	cust := customerIter.Customer()
 
-	amountCents := int64(invoice.Amount * 100)
+	// rounded like invoiceAmountCents, so autopay charges what Checkout would
+	amountCents := int64(math.Round(invoice.Amount * 100))
 
 	// Create PaymentIntent parameters.
 	piParams := &stripe.PaymentIntentParams{
@@ -54,6 +70,19 @@ func createStripeCharge(invoice Invoice, app *pocketbase.PocketBase) (bool, erro
 		Description:   stripe.String(invoice.InvoiceName),
 	}
 	piParams.AddMetadata("type", "invoice")
+	piParams.AddMetadata("invoice_id", invoice.ID)
+	piParams.AddMetadata("autopay", "true")
+	// Same invoice, due date, amount and failed attempts always map to the same
+	// key, so a second run on the same day returns the original PaymentIntent
+	// instead of charging again.
+	// autopay_attempts is written by the Stripe webhook; without it every
+	// attempt counts as the first
+	failedAttempts, err := app.CountRecords("autopay_attempts", dbx.HashExp{"invoice": invoice.ID, "status": "failed"})
+	if err != nil {
+		log.Default().Println(fmt.Errorf("failed to count autopay attempts, keying the charge as a first attempt: %w", err))
+		failedAttempts = 0
+	}
+	piParams.SetIdempotencyKey(chargeIdempotencyKey(invoice, amountCents, failedAttempts))
 
 	// Create the PaymentIntent.
 	pi, err := paymentintent.New(piParams)
@@ -73,6 +102,50 @@ func createStripeCharge(invoice Invoice, app *pocketbase.PocketBase) (bool, erro
 
 }
 
+// chargeIdempotencyKey builds the Stripe idempotency key for an invoice charge.
+// Stripe rejects a reused key with other parameters, so the amount is part of
+// it, and it replays the saved response, so is the number of failed attempts:
+// a retry after a declined charge gets a new key instead of the old decline.
+func chargeIdempotencyKey(invoice Invoice, amountCents int64, failedAttempts int64) string {
+	return fmt.Sprintf("invoice-%s-%s-%d-%d", invoice.ID, invoice.DueDate.Time().Format("2006-01-02"), amountCents, failedAttempts)
+}
+
+// hasActiveCharge checks the PaymentIntent (or Checkout session) stored in the
+// invoice session field and reports whether it is pending or has succeeded.
+func hasActiveCharge(sessionID string) (bool, error) {
+	var pi *stripe.PaymentIntent
+	switch {
+	case strings.HasPrefix(sessionID, "pi_"):
+		var err error
+		pi, err = paymentintent.Get(sessionID, nil)
+		if err != nil {
+			return false, fmt.Errorf("failed to retrieve payment intent %s: %w", sessionID, err)
+		}
+	case strings.HasPrefix(sessionID, "cs_"):
+		params := &stripe.CheckoutSessionParams{}
+		params.AddExpand("payment_intent")
+		cs, err := session.Get(sessionID, params)
+		if err != nil {
+			return false, fmt.Errorf("failed to retrieve checkout session %s: %w", sessionID, err)
+		}
+		if cs.PaymentStatus == stripe.CheckoutSessionPaymentStatusPaid {
+			return true, nil
+		}
+		pi = cs.PaymentIntent
+	}
+	if pi == nil {
+		return false, nil
+	}
+	switch pi.Status {
+	case stripe.PaymentIntentStatusSucceeded,
+		stripe.PaymentIntentStatusProcessing,
+		stripe.PaymentIntentStatusRequiresCapture,
+		stripe.PaymentIntentStatusRequiresAction:
+		return true, nil
+	}
+	return false, nil
+}
+
 type AutoPayForce struct {
 	InvoiceID string `json:"invoice_id"`
 }
@@ -89,6 +162,9 @@ func InvoiceAutopayForceRoute(e *core.RequestEvent) error {
 	if err != nil {
 		return e.JSON(404, map[string]string{"error": "Invoice not found"})
 	}
+	if record.GetBool("paid") {
+		return e.JSON(409, map[string]string{"error": "Invoice has already been paid"})
+	}
 
 	invoice := Invoice{}
 	// Using custom decoder configuration with WeaklyTypedInput option
@@ -108,6 +184,9 @@ func InvoiceAutopayForceRoute(e *core.RequestEvent) error {
 	}
 
 	charged, err := createStripeCharge(invoice, e.App.(*pocketbase.PocketBase))
+	if errors.Is(err, ErrChargeExists) {
+		return e.JSON(409, map[string]string{"error": "Invoice already has a pending or successful payment"})
+	}
 	if err != nil {
 		return e.JSON(500, map[string]string{"error": "Failed to create charge"})
 	}
@@ -173,7 +252,7 @@ func generate_link_invoice(e *core.RequestEvent) error {
 			return e.Redirect(302, sessionURL)
 		}
 	}
-	paySession, err := generateSession(record)
+	paySession, err := generateSession(record, false)
 	if err != nil {
 		log.Printf("Error generating session: %v", err)
 		return e.JSON(500, map[string]string{"error": "Failed to generate payment session"})
@@ -188,56 +267,16 @@ func generate_link_invoice(e *core.RequestEvent) error {
 	return e.Redirect(302, paySession.URL)
 }
 
-func generateSession(invoice *core.Record) (*stripe.CheckoutSession, error) {
-	// Check if customer exists based on the invoice email.
-	email := invoice.GetString("email")
-	name := invoice.GetString("name")
-
-	// Try to get expanded members - they may already be expanded
-	allMembers := invoice.ExpandedAll("members")
-	if len(allMembers) > 0 {
-		firstMember := allMembers[0]
-		memberName := firstMember.GetString("first_name") + " " + firstMember.GetString("last_name")
-		memberEmail := firstMember.GetString("email")
-		if memberEmail != "" {
-			email = memberEmail
-			name = memberName
-		}
-	}
-	custParams := &stripe.CustomerListParams{
-		Email: stripe.String(email),
-	}
-	custParams.Limit = stripe.Int64(1)
-	ci := customer.List(custParams)
-	var cust *stripe.Customer
-	if ci.Next() {
-		cust = ci.Customer()
-	} else {
-		createParams := &stripe.CustomerParams{
-			Email: stripe.String(email),
-			Name:  stripe.String(name),
-		}
-		var err error
-		cust, err = customer.New(createParams)
-		if err != nil {
-			log.Printf("Error creating customer: %v", err)
-			return nil, err
-		}
-	}
-
-	// Convert invoice amount to the proper unit.
-	// Assumes invoice["amount"] is either string or a float64.
-	var unitAmount int64
-	switch v := invoice.Get("amount").(type) {
-	case string:
-		if f, err := strconv.ParseFloat(v, 64); err == nil {
-			unitAmount = int64(f * 100)
-		}
-	case float64:
-		unitAmount = int64(v * 100)
-	default:
-		unitAmount = 0
+// generateSession creates a Checkout session for the invoice. When embedded is
+// true the session is created in embedded UI mode and the caller should hand the
+// client secret to Stripe.js instead of redirecting to the session URL.
+func generateSession(invoice *core.Record, embedded bool) (*stripe.CheckoutSession, error) {
+	email, name := invoiceBillingContact(invoice)
+	cust, err := findOrCreateCustomer(email, name)
+	if err != nil {
+		return nil, err
 	}
+	unitAmount := invoiceAmountCents(invoice)
 
 	// Build the checkout session parameters.
 	// Retrieve additional invoice details.
@@ -278,8 +317,14 @@ func generateSession(invoice *core.Record) (*stripe.CheckoutSession, error) {
 		}
 	}
 
-	sessionParams.SuccessURL = stripe.String("https://nextmilmastermind.com/thank-you")
-	sessionParams.CancelURL = stripe.String("https://nextmilmastermind.com")
+	successURL, cancelURL := invoiceRedirectURLs(invoice)
+	if embedded {
+		sessionParams.UIMode = stripe.String(string(stripe.CheckoutSessionUIModeEmbedded))
+		sessionParams.ReturnURL = stripe.String(successURL)
+	} else {
+		sessionParams.SuccessURL = stripe.String(successURL)
+		sessionParams.CancelURL = stripe.String(cancelURL)
+	}
 
 	paySession, err := session.New(sessionParams)
 	if err != nil {
@@ -288,16 +333,4 @@ func generateSession(invoice *core.Record) (*stripe.CheckoutSession, error) {
 	}
 
 	return paySession, nil
-	/*pb.UpdateInvoice(invoiceID, updateData)
-
-	response := map[string]any{"status": "success"}
-	if sendDataback {
-		response["invoice"] = invoice
-	}
-	if isEmbedded {
-		response["clientsecret"] = paySession.ClientSecret
-	} else {
-		response["url"] = paySession.URL
-	}
-	return response*/
 }
@@ -0,0 +1,24 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func TestChargeIdempotencyKey(t *testing.T) {
+	due, _ := types.ParseDateTime(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC))
+	invoice := Invoice{ID: "inv1", DueDate: due}
+
+	key := chargeIdempotencyKey(invoice, 50000, 0)
+	if key != chargeIdempotencyKey(invoice, 50000, 0) {
+		t.Error("the same charge should reuse its key")
+	}
+	if key == chargeIdempotencyKey(invoice, 52500, 0) {
+		t.Error("a changed amount should get a new key")
+	}
+	if key == chargeIdempotencyKey(invoice, 50000, 1) {
+		t.Error("a retry after a failed attempt should get a new key")
+	}
+}
@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// LateFeeRule is a record of the late_fee_rules collection.
+//
+// Kind is "flat" (Value is dollars) or "percent" (Value is a percentage of the
+// invoice amount before late fees). A rule applies once per invoice, GraceDays
+// after the due date. Cap, when set, is the most late fees an invoice may carry
+// in total. InvoiceType limits the rule to one invoice type; empty matches all.
+type LateFeeRule struct {
+	ID          string
+	Name        string
+	InvoiceType string
+	Kind        string
+	Value       float64
+	GraceDays   int
+	Cap         float64
+}
+
+// LateFeeEntry is one entry of the late_fee_log audit trail on an invoice.
+type LateFeeEntry struct {
+	RuleID         string    `json:"rule_id"`
+	Rule           string    `json:"rule"`
+	Fee            float64   `json:"fee"`
+	PreviousAmount float64   `json:"previous_amount"`
+	NewAmount      float64   `json:"new_amount"`
+	AppliedAt      time.Time `json:"applied_at"`
+}
+
+func (r *LateFeeRule) FromRecord(record *core.Record) {
+	r.ID = record.Id
+	r.Name = record.GetString("name")
+	r.InvoiceType = record.GetString("invoice_type")
+	r.Kind = record.GetString("kind")
+	r.Value = record.GetFloat("value")
+	r.GraceDays = record.GetInt("grace_days")
+	r.Cap = record.GetFloat("cap")
+}
+
+// Matches reports whether the rule applies to an invoice of the given type.
+func (r LateFeeRule) Matches(invoiceType string) bool {
+	if r.InvoiceType == "" {
+		return true
+	}
+	if invoiceType == "" {
+		invoiceType = "standard"
+	}
+	return r.InvoiceType == invoiceType
+}
+
+// Fee returns the fee this rule adds to an invoice whose amount before late
+// fees is base and which already carries applied in late fees.
+func (r LateFeeRule) Fee(base, applied float64) float64 {
+	var fee float64
+	switch r.Kind {
+	case "flat":
+		fee = r.Value
+	case "percent":
+		fee = base * r.Value / 100
+	default:
+		return 0
+	}
+	if r.Cap > 0 && applied+fee > r.Cap {
+		fee = r.Cap - applied
+	}
+	if fee <= 0 {
+		return 0
+	}
+	return math.Round(fee*100) / 100
+}
+
+// ApplyLateFees adds late fees to overdue invoices according to the active
+// late_fee_rules. Applied fees raise the invoice amount, are summed in late_fee
+// and are logged in late_fee_log, which also keeps a rule from applying twice.
+func ApplyLateFees(app *pocketbase.PocketBase) {
+	ruleRecords, err := app.FindRecordsByFilter("late_fee_rules", "active = true", "grace_days", 0, 0)
+	if err != nil {
+		log.Default().Println(fmt.Errorf("failed to load late fee rules: %w", err))
+		return
+	}
+	if len(ruleRecords) == 0 {
+		return
+	}
+	rules := make([]LateFeeRule, len(ruleRecords))
+	for i, r := range ruleRecords {
+		rules[i].FromRecord(r)
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for _, rule := range rules {
+		cutoff := today.AddDate(0, 0, -rule.GraceDays)
+		invoices, err := app.FindRecordsByFilter(
+			"invoices",
+			"paid = false && duedate < {:cutoff}",
+			"",
+			0,
+			0,
+			dbx.Params{"cutoff": cutoff.Format("2006-01-02 15:04:05")},
+		)
+		if err != nil {
+			log.Default().Println(fmt.Errorf("failed to load overdue invoices: %w", err))
+			continue
+		}
+		for _, invoice := range invoices {
+			if !rule.Matches(invoice.GetString("type")) {
+				continue
+			}
+			if err := applyLateFee(app, invoice, rule, today); err != nil {
+				log.Default().Println(err)
+			}
+		}
+	}
+}
+
+func applyLateFee(app *pocketbase.PocketBase, invoice *core.Record, rule LateFeeRule, now time.Time) error {
+	var entries []LateFeeEntry
+	if invoice.GetString("late_fee_log") != "" {
+		if err := invoice.UnmarshalJSONField("late_fee_log", &entries); err != nil {
+			return fmt.Errorf("invoice %s: failed to read late_fee_log: %w", invoice.Id, err)
+		}
+	}
+	for _, entry := range entries {
+		if entry.RuleID == rule.ID {
+			return nil
+		}
+	}
+
+	amount := float64(invoiceAmountCents(invoice)) / 100
+	applied := invoice.GetFloat("late_fee")
+	fee := rule.Fee(amount-applied, applied)
+	if fee == 0 {
+		return nil
+	}
+	newAmount := math.Round((amount+fee)*100) / 100
+	entries = append(entries, LateFeeEntry{
+		RuleID:         rule.ID,
+		Rule:           rule.Name,
+		Fee:            fee,
+		PreviousAmount: amount,
+		NewAmount:      newAmount,
+		AppliedAt:      now,
+	})
+	invoice.Set("amount", newAmount)
+	invoice.Set("late_fee", math.Round((applied+fee)*100)/100)
+	invoice.Set("late_fee_log", entries)
+	// a cached Checkout link would still charge the old amount
+	invoice.Set("session_url", "")
+	if err := app.Save(invoice); err != nil {
+		return fmt.Errorf("invoice %s: failed to save late fee: %w", invoice.Id, err)
+	}
+	log.Default().Printf("Applied late fee %.2f (%s) to invoice %s\n", fee, rule.Name, invoice.Id)
+	return nil
+}
@@ -0,0 +1,36 @@
+package lib
+
+import "testing"
+
+func TestLateFeeRuleFee(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    LateFeeRule
+		base    float64
+		applied float64
+		want    float64
+	}{
+		{"flat", LateFeeRule{Kind: "flat", Value: 25}, 500, 0, 25},
+		{"percent", LateFeeRule{Kind: "percent", Value: 1.5}, 333.33, 0, 5},
+		{"capped", LateFeeRule{Kind: "flat", Value: 25, Cap: 40}, 500, 25, 15},
+		{"cap reached", LateFeeRule{Kind: "flat", Value: 25, Cap: 40}, 500, 40, 0},
+		{"unknown kind", LateFeeRule{Kind: "daily", Value: 25}, 500, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.Fee(tt.base, tt.applied); got != tt.want {
+			t.Errorf("%s: got %.2f, want %.2f", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLateFeeRuleMatches(t *testing.T) {
+	if !(LateFeeRule{}).Matches("auto") {
+		t.Error("rule without invoice type should match every invoice")
+	}
+	if !(LateFeeRule{InvoiceType: "standard"}).Matches("") {
+		t.Error("empty invoice type should be treated as standard")
+	}
+	if (LateFeeRule{InvoiceType: "auto"}).Matches("standard") {
+		t.Error("auto rule should not match standard invoices")
+	}
+}
@@ -29,16 +29,27 @@ type MessageVersion struct {
 	To     []Contact        `json:"to"`
 	Params map[string]any   `json:"params"`
 	CC     []map[string]any `json:"cc,omitempty"`
+	BCC    []map[string]any `json:"bcc,omitempty"`
+	// optional content rendered for this version, overriding the payload's
+	Subject     string `json:"subject,omitempty"`
+	HTMLContent string `json:"htmlContent,omitempty"`
+	TextContent string `json:"textContent,omitempty"`
 }
 
 type EmailData struct {
 	Sender          Contact            `json:"sender"`
 	Subject         string             `json:"subject"`
-	HTMLContent     string             `json:"htmlContent"`
+	HTMLContent     string             `json:"htmlContent,omitempty"`
+	TextContent     string             `json:"textContent,omitempty"`
 	MessageVersions []MessageVersion   `json:"messageVersions"`
 	ReplyTo         Contact            `json:"replyTo"`
 	ScheduledAt     *string            `json:"scheduledAt,omitempty"`
+	BatchID         string             `json:"batchId,omitempty"`
 	Attachment      *[]BrevoAttachment `json:"attachment,omitempty"`
+	Headers         map[string]string  `json:"headers,omitempty"`
+	// Sensitive marks an email carrying a secret, like a login code. It is
+	// never stored in full, see deliverEmail.
+	Sensitive bool `json:"-"`
 }
 type BrevoAttachment struct {
 	URL     *string `json:"url,omitempty"`
@@ -52,7 +63,9 @@ type Recipient struct {
 	Email     string
 	FirstName string
 	Params    *map[string]any
-	CC        []map[string]any // optional CC recipients
+	CC        []map[string]any  // optional CC recipients
+	BCC       []map[string]any  // optional BCC recipients
+	Content   *RenderedTemplate // optional content rendered for this recipient
 }
 
 // Contact represents a sender, replyTo, or recipient in the request.
@@ -0,0 +1,277 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+const (
+	otpCodeTTL     = 10 * time.Minute
+	otpMaxAttempts = 5
+	// at most otpMaxPerAccount codes per account and otpMaxPerIP requests per
+	// IP within otpRateWindow
+	otpRateWindow    = 15 * time.Minute
+	otpMaxPerAccount = 3
+	otpMaxPerIP      = 10
+	// after otpMaxFailures wrong codes within otpFailureWindow an account gets
+	// no more codes until the oldest failures fall out of the window
+	otpFailureWindow   = 24 * time.Hour
+	otpMaxFailures     = 10
+	otpLoginCollection = "members"
+)
+
+// phoneDigits keeps the last ten digits of a phone number, so +1 (813)
+// 819-4188 and 813.819.4188 compare equal.
+func phoneDigits(phone string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phone)
+	if len(digits) > 10 {
+		digits = digits[len(digits)-10:]
+	}
+	return digits
+}
+
+// findMemberByPhone matches members whatever format their phone is stored in.
+// A phone shared by several members, like a household line, matches none, as
+// there is no telling whose account the code is for.
+func findMemberByPhone(app core.App, phone string) (*core.Record, error) {
+	digits := phoneDigits(phone)
+	if len(digits) < 10 {
+		return nil, fmt.Errorf("invalid phone number")
+	}
+	records, err := app.FindRecordsByFilter(otpLoginCollection, "phone ~ {:last4}", "", 0, 0, dbx.Params{"last4": digits[6:]})
+	if err != nil {
+		return nil, err
+	}
+	var found *core.Record
+	for _, record := range records {
+		if phoneDigits(record.GetString("phone")) != digits {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("phone is shared by several members")
+		}
+		found = record
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no member with this phone")
+	}
+	return found, nil
+}
+
+// otpRateLimited reports whether another code may not be sent, counting the
+// records of collection created within otpRateWindow that match exp.
+func otpRateLimited(app core.App, collection string, exp dbx.Expression, max int) bool {
+	since := time.Now().UTC().Add(-otpRateWindow).Format("2006-01-02 15:04:05.000Z")
+	n, err := app.CountRecords(collection, exp, dbx.NewExp("created >= {:since}", dbx.Params{"since": since}))
+	if err != nil {
+		return true
+	}
+	return n >= int64(max)
+}
+
+// otpFailures counts the wrong codes entered for an account within
+// otpFailureWindow. Every guess is counted on its code; a used code had one
+// right guess.
+func otpFailures(app core.App, recordID string) (int, error) {
+	since := time.Now().UTC().Add(-otpFailureWindow).Format("2006-01-02 15:04:05.000Z")
+	var row struct {
+		Failures int `db:"failures"`
+	}
+	err := app.DB().Select("COALESCE(SUM(CASE WHEN used THEN attempts - 1 ELSE attempts END), 0) AS failures").
+		From("login_codes").
+		Where(dbx.HashExp{"record": recordID}).
+		AndWhere(dbx.NewExp("created >= {:since}", dbx.Params{"since": since})).
+		One(&row)
+	return row.Failures, err
+}
+
+// otpLockedOut reports whether an account had too many wrong codes lately.
+func otpLockedOut(app core.App, recordID string) bool {
+	failures, err := otpFailures(app, recordID)
+	return err != nil || failures >= otpMaxFailures
+}
+
+// RegisterOTPLoginRoutes registers one-time code login for members. A code is
+// sent by email or text, and verifying it returns the same body as the
+// PocketBase auth endpoints. Requests get the same answer whether or not the
+// account exists. After otpMaxFailures wrong codes in a day the account is
+// locked out of code login and the member is told. Codes are kept in login_codes (collection, record, channel,
+// token_hash, code_hash, attempts, expires, used, ip).
+func RegisterOTPLoginRoutes(sr *router.Router[*core.RequestEvent], app *pocketbase.PocketBase) {
+	sr.POST("/auth/otp/request", func(e *core.RequestEvent) error {
+		var body struct {
+			Email   string `json:"email"`
+			Phone   string `json:"phone"`
+			Channel string `json:"channel"`
+		}
+		if err := e.BindBody(&body); err != nil {
+			return apis.NewBadRequestError("Invalid request body.", err)
+		}
+		channel := firstNonEmpty(body.Channel, "email")
+		if channel != "email" && channel != "sms" {
+			return apis.NewBadRequestError("channel must be email or sms.", nil)
+		}
+		if (channel == "email" && body.Email == "") || (channel == "sms" && body.Phone == "") {
+			return apis.NewBadRequestError("An email or phone number is required.", nil)
+		}
+		if otpRateLimited(app, "login_codes", dbx.HashExp{"ip": e.RealIP()}, otpMaxPerIP) {
+			return e.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many requests, please try again later"})
+		}
+
+		token := security.RandomString(40)
+		response := map[string]any{
+			"otp_id":  token,
+			"message": "If an account matches, a code has been sent.",
+		}
+		var authRecord *core.Record
+		var err error
+		if channel == "email" {
+			authRecord, err = app.FindAuthRecordByEmail(otpLoginCollection, strings.TrimSpace(body.Email))
+		} else {
+			authRecord, err = findMemberByPhone(app, body.Phone)
+		}
+		if err != nil {
+			authRecord = nil
+		}
+		collection, err := app.FindCollectionByNameOrId("login_codes")
+		if err != nil {
+			return apis.NewInternalServerError("Failed to send code.", err)
+		}
+		code := newOTP()
+		hashes, err := hashSecrets(token, code)
+		if err != nil {
+			return apis.NewInternalServerError("Failed to send code.", err)
+		}
+		record := core.NewRecord(collection)
+		record.Set("collection", otpLoginCollection)
+		record.Set("channel", channel)
+		record.Set("token_hash", hashes[0])
+		record.Set("code_hash", hashes[1])
+		record.Set("attempts", 0)
+		record.Set("expires", time.Now().UTC().Add(otpCodeTTL))
+		record.Set("ip", e.RealIP())
+		if authRecord == nil || otpRateLimited(app, "login_codes", dbx.HashExp{"record": authRecord.Id}, otpMaxPerAccount) ||
+			otpLockedOut(app, authRecord.Id) {
+			// nothing is sent, but the request is counted for the IP limit
+			record.Set("used", true)
+			if err := app.Save(record); err != nil {
+				return apis.NewInternalServerError("Failed to send code.", err)
+			}
+			return e.JSON(http.StatusOK, response)
+		}
+		record.Set("record", authRecord.Id)
+		if err := app.Save(record); err != nil {
+			return apis.NewInternalServerError("Failed to send code.", err)
+		}
+
+		// queued, so neither the response nor its timing reveals the account
+		if channel == "email" {
+			EnqueueSensitiveEmail([]Recipient{{Email: authRecord.Email(), Name: firstNonEmpty(authRecord.GetString("first_name"), authRecord.Email())}},
+				"Your login code",
+				fmt.Sprintf("<p>Your login code is <b>%s</b>. It expires in 10 minutes.</p>"+
+					"<p>If you didn't try to log in, you can ignore this email.</p>", code))
+		} else {
+			sendSMS(authRecord.GetString("phone"), fmt.Sprintf("Your login code is %s. It expires in 10 minutes.", code))
+		}
+		RecordAuthEvent(app, e, AuthEvent{
+			Event:      "otp_requested",
+			Method:     AuthMethodOTP,
+			Collection: otpLoginCollection,
+			RecordID:   authRecord.Id,
+			Email:      authRecord.Email(),
+			Details:    map[string]any{"channel": channel},
+		})
+		return e.JSON(http.StatusOK, response)
+	})
+
+	sr.POST("/auth/otp/verify", func(e *core.RequestEvent) error {
+		var body struct {
+			OTPID string `json:"otp_id"`
+			Code  string `json:"code"`
+		}
+		if err := e.BindBody(&body); err != nil || body.OTPID == "" || body.Code == "" {
+			return apis.NewBadRequestError("otp_id and code are required.", err)
+		}
+		tokenHash, err := hashSecret(body.OTPID)
+		if err != nil {
+			return apis.NewInternalServerError("Failed to verify code.", err)
+		}
+		record, err := app.FindFirstRecordByData("login_codes", "token_hash", tokenHash)
+		if err != nil || record.GetBool("used") || record.GetString("record") == "" ||
+			record.GetDateTime("expires").Time().Before(time.Now()) ||
+			record.GetInt("attempts") >= otpMaxAttempts {
+			return apis.NewBadRequestError("Invalid or expired code.", nil)
+		}
+		if otpLockedOut(app, record.GetString("record")) {
+			return apis.NewBadRequestError("Invalid or expired code.", nil)
+		}
+		event := AuthEvent{
+			Event:      "otp_verify",
+			Method:     AuthMethodOTP,
+			Collection: record.GetString("collection"),
+			RecordID:   record.GetString("record"),
+			Details:    map[string]any{"channel": record.GetString("channel")},
+		}
+		// the guess is counted before the code is checked
+		allowed, err := useAttempt(app, "login_codes", record.Id, otpMaxAttempts)
+		if err != nil {
+			return apis.NewInternalServerError("Failed to verify code.", err)
+		}
+		if !allowed {
+			return apis.NewBadRequestError("Invalid or expired code.", nil)
+		}
+		if !secretMatches(body.Code, record.GetString("code_hash")) {
+			RecordAuthFailure(app, e, event, nil)
+			if failures, err := otpFailures(app, event.RecordID); err == nil && failures == otpMaxFailures {
+				notifyOTPLockout(app, e, event)
+			}
+			return apis.NewBadRequestError("Invalid or expired code.", nil)
+		}
+
+		// one use only, even if two verifications race
+		res, err := app.DB().Update("login_codes", dbx.Params{"used": true}, dbx.HashExp{"id": record.Id, "used": false}).Execute()
+		if err != nil {
+			return apis.NewInternalServerError("Failed to verify code.", err)
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			return apis.NewBadRequestError("Invalid or expired code.", nil)
+		}
+		authRecord, err := app.FindRecordById(record.GetString("collection"), record.GetString("record"))
+		if err != nil {
+			return apis.NewBadRequestError("Invalid or expired code.", nil)
+		}
+		// the login itself is recorded by the auth request hook
+		return apis.RecordAuthResponse(e, authRecord, "otp", nil)
+	})
+}
+
+// notifyOTPLockout tells the member their account just reached otpMaxFailures,
+// so someone may be guessing their codes.
+func notifyOTPLockout(app core.App, e *core.RequestEvent, event AuthEvent) {
+	authRecord, err := app.FindRecordById(event.Collection, event.RecordID)
+	if err != nil {
+		fmt.Printf("failed to load account for the login code lockout notice: %v\n", err)
+		return
+	}
+	event.Event = "otp_locked"
+	event.Outcome = AuthFlagged
+	event.Email = authRecord.Email()
+	RecordAuthEvent(app, e, event)
+	notifyAccount(authRecord, "Login codes paused",
+		fmt.Sprintf("Too many wrong login codes were entered for your account, so no codes will be sent for the next %d hours. "+
+			"If this wasn't you, someone may be trying to get in. You can still sign in with your passkey or password.", int(otpFailureWindow.Hours())))
+}
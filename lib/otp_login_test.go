@@ -0,0 +1,323 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+func TestPhoneDigits(t *testing.T) {
+	for _, phone := range []string{"8138194188", "813-819-4188", "(813)819-4188", "813.819.4188", "+18138194188", "+1 (813) 819-4188"} {
+		if got := phoneDigits(phone); got != "8138194188" {
+			t.Errorf("phoneDigits(%q) = %q", phone, got)
+		}
+	}
+	if got := phoneDigits("4188"); got != "4188" {
+		t.Errorf("phoneDigits(short) = %q", got)
+	}
+}
+
+// testEmailProvider keeps the emails sent during a test.
+type testEmailProvider struct {
+	mu   sync.Mutex
+	sent []EmailData
+}
+
+func (*testEmailProvider) Name() string { return "test" }
+
+func (p *testEmailProvider) Send(payload EmailData) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent = append(p.sent, payload)
+	return nil
+}
+
+// waitFor returns the first email with subject, waiting for queued sends.
+func (p *testEmailProvider) waitFor(t *testing.T, subject string) EmailData {
+	t.Helper()
+	for range 200 {
+		p.mu.Lock()
+		for _, payload := range p.sent {
+			if payload.Subject == subject {
+				p.mu.Unlock()
+				return payload
+			}
+		}
+		p.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("no %q email was sent", subject)
+	return EmailData{}
+}
+
+func (p *testEmailProvider) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent = nil
+}
+
+func (p *testEmailProvider) count(subject string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, payload := range p.sent {
+		if payload.Subject == subject {
+			n++
+		}
+	}
+	return n
+}
+
+var testCodePattern = regexp.MustCompile(`<b>(\d{6})</b>`)
+
+func (p *testEmailProvider) code(t *testing.T, subject string) string {
+	t.Helper()
+	match := testCodePattern.FindStringSubmatch(p.waitFor(t, subject).HTMLContent)
+	if match == nil {
+		t.Fatalf("no code in the %q email", subject)
+	}
+	return match[1]
+}
+
+// newAuthTestApp is a test app with a members collection and the collections
+// the code login and passkey recovery routes keep their state and audit log
+// in. Emails go to the returned provider.
+func newAuthTestApp(t *testing.T) (*pocketbase.PocketBase, *testEmailProvider) {
+	t.Helper()
+	t.Setenv("OTP_SECRET", "test")
+	t.Setenv("OPENPHONE_FROM_NUMBER", "")
+	testApp, err := tests.NewTestApp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(testApp.Cleanup)
+
+	timestamps := []core.Field{
+		&core.AutodateField{Name: "created", OnCreate: true},
+		&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+	}
+	members := core.NewAuthCollection("members")
+	members.Fields.Add(
+		&core.TextField{Name: "username"},
+		&core.TextField{Name: "first_name"},
+		&core.TextField{Name: "phone"},
+		&core.TextField{Name: WEBAUTHN_ID_B64_FIELDNAME},
+		&core.TextField{Name: WEBAUTHN_CREDENTIALS_FIELDNAME},
+		&core.JSONField{Name: "credentials_list"},
+	)
+	members.Fields.Add(timestamps...)
+	loginCodes := core.NewBaseCollection("login_codes")
+	loginCodes.Fields.Add(
+		&core.TextField{Name: "collection"},
+		&core.TextField{Name: "record"},
+		&core.TextField{Name: "channel"},
+		&core.TextField{Name: "token_hash"},
+		&core.TextField{Name: "code_hash"},
+		&core.NumberField{Name: "attempts"},
+		&core.DateField{Name: "expires"},
+		&core.BoolField{Name: "used"},
+		&core.TextField{Name: "ip"},
+	)
+	loginCodes.Fields.Add(timestamps...)
+	recoveries := core.NewBaseCollection("passkey_recoveries")
+	recoveries.Fields.Add(
+		&core.TextField{Name: "collection"},
+		&core.TextField{Name: "record"},
+		&core.TextField{Name: "email"},
+		&core.TextField{Name: "token_hash"},
+		&core.TextField{Name: "email_code_hash"},
+		&core.TextField{Name: "sms_code_hash"},
+		&core.TextField{Name: "cancel_token_hash"},
+		&core.NumberField{Name: "attempts"},
+		&core.TextField{Name: "status"},
+		&core.DateField{Name: "expires"},
+		&core.DateField{Name: "ready_at"},
+		&core.TextField{Name: "ip"},
+	)
+	recoveries.Fields.Add(timestamps...)
+	authEvents := core.NewBaseCollection("auth_events")
+	authEvents.Fields.Add(
+		&core.TextField{Name: "event"},
+		&core.TextField{Name: "method"},
+		&core.TextField{Name: "outcome"},
+		&core.TextField{Name: "collection"},
+		&core.TextField{Name: "record"},
+		&core.TextField{Name: "email"},
+		&core.JSONField{Name: "details"},
+		&core.TextField{Name: "ip"},
+		&core.TextField{Name: "user_agent"},
+	)
+	authEvents.Fields.Add(timestamps...)
+	for _, collection := range []*core.Collection{members, loginCodes, recoveries, authEvents} {
+		if err := testApp.Save(collection); err != nil {
+			t.Fatalf("create %s: %v", collection.Name, err)
+		}
+	}
+
+	provider := &testEmailProvider{}
+	previous := CurrentEmailProvider()
+	SetEmailProvider(provider)
+	t.Cleanup(func() { SetEmailProvider(previous) })
+	return &pocketbase.PocketBase{App: testApp}, provider
+}
+
+func newTestMember(t *testing.T, app core.App, email string) *core.Record {
+	t.Helper()
+	collection, err := app.FindCollectionByNameOrId("members")
+	if err != nil {
+		t.Fatal(err)
+	}
+	member := core.NewRecord(collection)
+	member.SetEmail(email)
+	member.SetPassword("password123")
+	member.Set("first_name", "Ada")
+	if err := app.Save(member); err != nil {
+		t.Fatal(err)
+	}
+	return member
+}
+
+// testRoutes serves the routes added by register on a PocketBase router.
+func testRoutes(t *testing.T, app core.App, register func(*router.Router[*core.RequestEvent])) http.Handler {
+	t.Helper()
+	r, err := apis.NewRouter(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register(r)
+	mux, err := r.BuildMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mux
+}
+
+func postJSON(t *testing.T, handler http.Handler, path string, body any) (int, map[string]any) {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(string(b)))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var response map[string]any
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	return rec.Code, response
+}
+
+func TestOTPLoginRoutes(t *testing.T) {
+	app, emails := newAuthTestApp(t)
+	member := newTestMember(t, app, "ada@example.com")
+	handler := testRoutes(t, app, func(r *router.Router[*core.RequestEvent]) {
+		RegisterOTPLoginRoutes(r, app)
+	})
+	request := func(email string) string {
+		t.Helper()
+		status, body := postJSON(t, handler, "/auth/otp/request", map[string]string{"email": email})
+		if status != http.StatusOK || body["otp_id"] == "" {
+			t.Fatalf("request for %s: status %d, body %v", email, status, body)
+		}
+		if body["message"] != "If an account matches, a code has been sent." {
+			t.Errorf("request for %s: unexpected message %v", email, body["message"])
+		}
+		return body["otp_id"].(string)
+	}
+	verify := func(otpID, code string) int {
+		t.Helper()
+		status, _ := postJSON(t, handler, "/auth/otp/verify", map[string]string{"otp_id": otpID, "code": code})
+		return status
+	}
+	wrong := func(code string) string {
+		if code == "000000" {
+			return "111111"
+		}
+		return "000000"
+	}
+
+	t.Run("unknown account gets the same answer", func(t *testing.T) {
+		otpID := request("nobody@example.com")
+		if verify(otpID, "123456") != http.StatusBadRequest {
+			t.Error("a code for an unknown account verified")
+		}
+	})
+
+	t.Run("single use", func(t *testing.T) {
+		otpID := request("ada@example.com")
+		code := emails.code(t, "Your login code")
+		if status := verify(otpID, code); status != http.StatusOK {
+			t.Fatalf("right code: status %d", status)
+		}
+		if verify(otpID, code) != http.StatusBadRequest {
+			t.Error("a code was used twice")
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		emails.reset()
+		otpID := request("ada@example.com")
+		code := emails.code(t, "Your login code")
+		hash, _ := hashSecret(otpID)
+		_, err := app.DB().Update("login_codes", dbx.Params{"expires": time.Now().UTC().Add(-time.Minute).Format("2006-01-02 15:04:05.000Z")},
+			dbx.HashExp{"token_hash": hash}).Execute()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verify(otpID, code) != http.StatusBadRequest {
+			t.Error("an expired code verified")
+		}
+	})
+
+	// the rate limit window is per account, start over
+	if _, err := app.DB().Delete("login_codes", nil).Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("attempt cap", func(t *testing.T) {
+		emails.reset()
+		otpID := request("ada@example.com")
+		code := emails.code(t, "Your login code")
+		for range otpMaxAttempts {
+			if verify(otpID, wrong(code)) != http.StatusBadRequest {
+				t.Fatal("a wrong code verified")
+			}
+		}
+		if verify(otpID, code) != http.StatusBadRequest {
+			t.Error("the right code verified after the attempt cap")
+		}
+	})
+
+	t.Run("lockout after too many failures", func(t *testing.T) {
+		emails.reset()
+		otpID := request("ada@example.com")
+		code := emails.code(t, "Your login code")
+		for range otpMaxFailures - otpMaxAttempts {
+			verify(otpID, wrong(code))
+		}
+		emails.waitFor(t, "Login codes paused")
+
+		emails.reset()
+		request("ada@example.com")
+		time.Sleep(50 * time.Millisecond)
+		if emails.count("Your login code") != 0 {
+			t.Error("a code was sent to a locked out account")
+		}
+		failures, err := otpFailures(app, member.Id)
+		if err != nil || failures != otpMaxFailures {
+			t.Errorf("failures = %d, %v", failures, err)
+		}
+	})
+}
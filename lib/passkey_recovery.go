@@ -0,0 +1,540 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"maps"
+	"net/http"
+	"net/url"
+	"nmmpocket/openphone"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/hook"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+// Recovery statuses.
+const (
+	RecoveryPending   = "pending"
+	RecoveryVerified  = "verified"
+	RecoveryCompleted = "completed"
+	RecoveryCancelled = "cancelled"
+)
+
+const (
+	recoveryCodeTTL     = 30 * time.Minute
+	recoveryMaxAttempts = 5
+	// at most recoveryMaxPerAccount recoveries per account and
+	// recoveryMaxPerIP requests per IP within otpRateWindow
+	recoveryMaxPerAccount = 3
+	recoveryMaxPerIP      = 10
+	// recoveryCompleteWithin is how long after the cooling-off period a
+	// verified recovery can still be completed.
+	recoveryCompleteWithin = 7 * 24 * time.Hour
+	// recoveryCollection is the only collection that can recover by email and
+	// text. Staff accounts have stricter passkey policies and are reset by an
+	// admin instead.
+	recoveryCollection = "members"
+
+	registrationTokenType = "passkey_registration"
+	// RegistrationTokenHeader carries the token a completed recovery returns.
+	// It can only start a passkey registration, see AllowRecoveryRegistration.
+	RegistrationTokenHeader = "X-Passkey-Registration-Token"
+	// RegistrationTokenTTL is how long that token lasts.
+	RegistrationTokenTTL = 15 * time.Minute
+)
+
+// recoveryCoolingOff is the wait between verifying a recovery and wiping the
+// passkeys, from WEBAUTHN_RECOVERY_COOLING_OFF (default 24h). It gives the
+// real owner time to cancel from the notifications.
+func recoveryCoolingOff() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("WEBAUTHN_RECOVERY_COOLING_OFF")); err == nil {
+		return d
+	}
+	return 24 * time.Hour
+}
+
+// otpSecret is the key codes and tokens are hashed with. Nothing is hashed or
+// checked without one, so the codes can't be brute forced from a leaked table.
+func otpSecret() ([]byte, error) {
+	secret := firstNonEmpty(os.Getenv("OTP_SECRET"), os.Getenv("shared_secret"))
+	if secret == "" {
+		return nil, fmt.Errorf("OTP_SECRET is not set")
+	}
+	return []byte(secret), nil
+}
+
+// newOTP returns a six digit code.
+func newOTP() string {
+	return security.RandomStringWithAlphabet(6, "0123456789")
+}
+
+// hashSecret hashes codes and tokens before they are stored.
+func hashSecret(value string) (string, error) {
+	secret, err := otpSecret()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.TrimSpace(value)))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// hashSecrets hashes each value, see hashSecret.
+func hashSecrets(values ...string) ([]string, error) {
+	hashes := make([]string, len(values))
+	for i, value := range values {
+		hash, err := hashSecret(value)
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = hash
+	}
+	return hashes, nil
+}
+
+func secretMatches(value, hash string) bool {
+	valueHash, err := hashSecret(value)
+	return hash != "" && err == nil && hmac.Equal([]byte(valueHash), []byte(hash))
+}
+
+// useAttempt counts a guess against the record before it is checked, and
+// reports false once max guesses were made. The increment is a single
+// conditional update, so parallel requests can't get extra guesses.
+func useAttempt(app core.App, collection, id string, max int) (bool, error) {
+	res, err := app.DB().Update(collection, dbx.Params{"attempts": dbx.NewExp("attempts + 1")}, dbx.And(
+		dbx.HashExp{"id": id},
+		dbx.NewExp("attempts < {:max}", dbx.Params{"max": max}),
+	)).Execute()
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// setRecoveryStatus moves recovery from one status to another, along with
+// fields, and reports false when its status was no longer from.
+func setRecoveryStatus(app core.App, recovery *core.Record, from, to string, fields dbx.Params) bool {
+	params := dbx.Params{"status": to}
+	maps.Copy(params, fields)
+	res, err := app.DB().Update("passkey_recoveries", params, dbx.HashExp{"id": recovery.Id, "status": from}).Execute()
+	if err != nil {
+		fmt.Printf("failed to update recovery %s: %v\n", recovery.Id, err)
+		return false
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return false
+	}
+	for key, value := range params {
+		recovery.Set(key, value)
+	}
+	return true
+}
+
+// sendSMS queues a text from OPENPHONE_FROM_NUMBER. It does nothing when either
+// number is missing.
+func sendSMS(phone, content string) {
+	fromNumber := os.Getenv("OPENPHONE_FROM_NUMBER")
+	if phone == "" || fromNumber == "" {
+		return
+	}
+	openphone.Enqueue(openphone.MessageJob{
+		PhoneNumber: phone,
+		FromNumber:  fromNumber,
+		Content:     content,
+	})
+}
+
+// notifyAccount sends a security notice to the account's email and, if it has
+// one, its phone. Notices can carry a cancel link, so they are sent as
+// sensitive email.
+func notifyAccount(authRecord *core.Record, subject, message string) {
+	to := []Recipient{{
+		Email: authRecord.Email(),
+		Name:  firstNonEmpty(authRecord.GetString("first_name"), authRecord.GetString("name"), authRecord.Email()),
+	}}
+	if err := EmailSenderSensitive(to, subject, "<p>"+html.EscapeString(message)+"</p>"); err != nil {
+		fmt.Printf("failed to send security notice to %s: %v\n", authRecord.Email(), err)
+	}
+	sendSMS(authRecord.GetString("phone"), message)
+}
+
+// registrationKey signs registration tokens. Like stepUpKey it derives from
+// the record's token key.
+func registrationKey(record *core.Record) string {
+	return record.TokenKey() + record.Collection().AuthToken.Secret + registrationTokenType
+}
+
+// newRegistrationToken issues the token that lets a recovered account
+// register a new passkey.
+func newRegistrationToken(record *core.Record) (string, error) {
+	return security.NewJWT(jwt.MapClaims{
+		"id":           record.Id,
+		"collectionId": record.Collection().Id,
+		"type":         registrationTokenType,
+	}, registrationKey(record), RegistrationTokenTTL)
+}
+
+// verifyRegistrationToken returns the account a registration token is for.
+func verifyRegistrationToken(app core.App, token string) (*core.Record, error) {
+	unverified, err := security.ParseUnverifiedJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	collectionID, _ := unverified["collectionId"].(string)
+	id, _ := unverified["id"].(string)
+	record, err := app.FindRecordById(collectionID, id)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := security.ParseJWT(token, registrationKey(record))
+	if err != nil {
+		return nil, err
+	}
+	if claims["type"] != registrationTokenType || record.Collection().Name != recoveryCollection {
+		return nil, fmt.Errorf("not a passkey registration token")
+	}
+	return record, nil
+}
+
+// AllowRecoveryRegistration authenticates a request by the token from a
+// completed recovery, in RegistrationTokenHeader. Bind it before
+// apis.RequireAuth on the route that starts a passkey registration, and
+// nowhere else, so the token is never a session.
+func AllowRecoveryRegistration() *hook.Handler[*core.RequestEvent] {
+	return &hook.Handler[*core.RequestEvent]{
+		Id: "allowRecoveryRegistration",
+		Func: func(e *core.RequestEvent) error {
+			token := e.Request.Header.Get(RegistrationTokenHeader)
+			if token == "" || e.Auth != nil {
+				return e.Next()
+			}
+			record, err := verifyRegistrationToken(e.App, token)
+			if err != nil {
+				return apis.NewUnauthorizedError("The registration token is invalid or has expired.", err)
+			}
+			e.Auth = record
+			return e.Next()
+		},
+	}
+}
+
+func findRecovery(app core.App, token string) (*core.Record, error) {
+	if token == "" {
+		return nil, fmt.Errorf("missing recovery token")
+	}
+	hash, err := hashSecret(token)
+	if err != nil {
+		return nil, err
+	}
+	return app.FindFirstRecordByData("passkey_recoveries", "token_hash", hash)
+}
+
+// hasVerifiedRecovery reports whether the account has a verified recovery that
+// can still be completed. Only its cancel link may stop it, so a new start
+// can't be used to knock out the owner's recovery.
+func hasVerifiedRecovery(app core.App, collection, recordID string) bool {
+	since := time.Now().UTC().Add(-recoveryCompleteWithin).Format("2006-01-02 15:04:05.000Z")
+	n, err := app.CountRecords("passkey_recoveries",
+		dbx.HashExp{"collection": collection, "record": recordID, "status": RecoveryVerified},
+		dbx.NewExp("ready_at >= {:since}", dbx.Params{"since": since}),
+	)
+	return err != nil || n > 0
+}
+
+func findRecoveryByCancelToken(app core.App, token string) (*core.Record, error) {
+	if token == "" {
+		return nil, fmt.Errorf("missing cancel token")
+	}
+	hash, err := hashSecret(token)
+	if err != nil {
+		return nil, err
+	}
+	return app.FindFirstRecordByData("passkey_recoveries", "cancel_token_hash", hash)
+}
+
+func recoveryAuthEvent(event string, recovery *core.Record, details map[string]any) AuthEvent {
+	return AuthEvent{
+		Event:      event,
+		Method:     AuthMethodRecovery,
+		Collection: recovery.GetString("collection"),
+		RecordID:   recovery.GetString("record"),
+		Email:      recovery.GetString("email"),
+		Details:    details,
+	}
+}
+
+// RegisterPasskeyRecoveryRoutes registers the self-service recovery for
+// accounts that lost their passkeys:
+//
+//  1. start: a code is emailed, and texted too when the account has a phone.
+//  2. verify: both codes are checked and the cooling-off period starts. Every
+//     channel on the account is told, with a link to cancel.
+//  3. complete: after the cooling-off period the passkeys are removed and a
+//     registration token is returned. It is not a session; it can only start
+//     the registration of a new passkey, see AllowRecoveryRegistration.
+//
+// Only members can recover this way.
+//
+// Recoveries are kept in passkey_recoveries (collection, record, email,
+// token_hash, email_code_hash, sms_code_hash, cancel_token_hash, attempts,
+// status, expires, ready_at, ip). Starts are throttled per IP and per account
+// like OTP login codes.
+func RegisterPasskeyRecoveryRoutes(sr *router.Router[*core.RequestEvent], app *pocketbase.PocketBase) {
+	sr.POST("/webauthn/recovery/start", func(e *core.RequestEvent) error {
+		var body struct {
+			Email      string `json:"email"`
+			Collection string `json:"collection"`
+		}
+		if err := e.BindBody(&body); err != nil || body.Email == "" {
+			return apis.NewBadRequestError("An email is required.", err)
+		}
+		collection := firstNonEmpty(body.Collection, recoveryCollection)
+		if collection != recoveryCollection {
+			return apis.NewBadRequestError("Account recovery is only available to members. Please contact an administrator.", nil)
+		}
+		if _, err := otpSecret(); err != nil {
+			return apis.NewInternalServerError("Account recovery is not configured.", err)
+		}
+		if otpRateLimited(app, "passkey_recoveries", dbx.HashExp{"ip": e.RealIP()}, recoveryMaxPerIP) {
+			return e.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many requests, please try again later"})
+		}
+		// the same answer whether or not the account exists
+		token := security.RandomString(40)
+		response := map[string]any{
+			"recovery_token": token,
+			"message":        "If an account exists for this email, a code has been sent, and by text too if it has a phone number.",
+		}
+		recoveries, err := app.FindCollectionByNameOrId("passkey_recoveries")
+		if err != nil {
+			return apis.NewInternalServerError("Failed to start recovery.", err)
+		}
+		authRecord, err := app.FindAuthRecordByEmail(collection, strings.TrimSpace(body.Email))
+		if err != nil || otpRateLimited(app, "passkey_recoveries", dbx.HashExp{"record": authRecord.Id}, recoveryMaxPerAccount) ||
+			hasVerifiedRecovery(app, collection, authRecord.Id) {
+			// nothing is sent, but the request is counted for the IP limit
+			placeholder := core.NewRecord(recoveries)
+			placeholder.Set("collection", collection)
+			placeholder.Set("status", RecoveryCancelled)
+			placeholder.Set("ip", e.RealIP())
+			if err := app.Save(placeholder); err != nil {
+				return apis.NewInternalServerError("Failed to start recovery.", err)
+			}
+			return e.JSON(http.StatusOK, response)
+		}
+
+		// a new request replaces a pending one; a verified one is never replaced
+		_, err = app.DB().Update("passkey_recoveries", dbx.Params{"status": RecoveryCancelled}, dbx.HashExp{
+			"collection": collection,
+			"record":     authRecord.Id,
+			"status":     RecoveryPending,
+		}).Execute()
+		if err != nil {
+			return apis.NewInternalServerError("Failed to start recovery.", err)
+		}
+
+		emailCode := newOTP()
+		phone := authRecord.GetString("phone")
+		smsCode := ""
+		if phone != "" && os.Getenv("WEBAUTHN_RECOVERY_SMS") != "false" {
+			smsCode = newOTP()
+		}
+		hashes, err := hashSecrets(token, emailCode, smsCode)
+		if err != nil {
+			return apis.NewInternalServerError("Failed to start recovery.", err)
+		}
+		recovery := core.NewRecord(recoveries)
+		recovery.Set("collection", collection)
+		recovery.Set("record", authRecord.Id)
+		recovery.Set("email", authRecord.Email())
+		recovery.Set("token_hash", hashes[0])
+		recovery.Set("email_code_hash", hashes[1])
+		if smsCode != "" {
+			recovery.Set("sms_code_hash", hashes[2])
+		}
+		recovery.Set("attempts", 0)
+		recovery.Set("status", RecoveryPending)
+		recovery.Set("expires", time.Now().UTC().Add(recoveryCodeTTL))
+		recovery.Set("ip", e.RealIP())
+		if err := app.Save(recovery); err != nil {
+			return apis.NewInternalServerError("Failed to start recovery.", err)
+		}
+
+		// queued, so neither the response nor its timing reveals the account
+		EnqueueSensitiveEmail([]Recipient{{Email: authRecord.Email(), Name: authRecord.Email()}},
+			"Your account recovery code",
+			fmt.Sprintf("<p>Your code to recover your account is <b>%s</b>. It expires in 30 minutes.</p>"+
+				"<p>If you didn't ask to recover your account, you can ignore this email.</p>", emailCode))
+		if smsCode != "" {
+			sendSMS(phone, fmt.Sprintf("Your account recovery code is %s. It expires in 30 minutes.", smsCode))
+		}
+		RecordAuthEvent(app, e, recoveryAuthEvent("passkey_recovery_started", recovery, map[string]any{"sms": smsCode != ""}))
+		return e.JSON(http.StatusOK, response)
+	})
+
+	sr.POST("/webauthn/recovery/verify", func(e *core.RequestEvent) error {
+		var body struct {
+			RecoveryToken string `json:"recovery_token"`
+			EmailCode     string `json:"email_code"`
+			SMSCode       string `json:"sms_code"`
+		}
+		if err := e.BindBody(&body); err != nil {
+			return apis.NewBadRequestError("Invalid request body.", err)
+		}
+		recovery, err := findRecovery(app, body.RecoveryToken)
+		if err != nil || recovery.GetString("status") != RecoveryPending ||
+			recovery.GetDateTime("expires").Time().Before(time.Now()) ||
+			recovery.GetInt("attempts") >= recoveryMaxAttempts {
+			return apis.NewBadRequestError("This recovery has expired. Please start again.", nil)
+		}
+		allowed, err := useAttempt(app, "passkey_recoveries", recovery.Id, recoveryMaxAttempts)
+		if err != nil {
+			return apis.NewInternalServerError("Failed to update recovery.", err)
+		}
+		if !allowed {
+			return apis.NewBadRequestError("This recovery has expired. Please start again.", nil)
+		}
+		recovery.Set("attempts", recovery.GetInt("attempts")+1)
+		ok := secretMatches(body.EmailCode, recovery.GetString("email_code_hash"))
+		if smsHash := recovery.GetString("sms_code_hash"); smsHash != "" {
+			ok = ok && secretMatches(body.SMSCode, smsHash)
+		}
+		if !ok {
+			RecordAuthFailure(app, e, recoveryAuthEvent("passkey_recovery_verify", recovery, map[string]any{"attempts": recovery.GetInt("attempts")}), nil)
+			return apis.NewBadRequestError("Invalid code.", nil)
+		}
+
+		authRecord, err := app.FindRecordById(recovery.GetString("collection"), recovery.GetString("record"))
+		if err != nil {
+			return apis.NewNotFoundError("User not found.", err)
+		}
+		cancelToken := security.RandomString(40)
+		cancelHash, err := hashSecret(cancelToken)
+		if err != nil {
+			return apis.NewInternalServerError("Failed to update recovery.", err)
+		}
+		readyAt := time.Now().UTC().Add(recoveryCoolingOff())
+		// only one of two racing verifications starts the cooling-off period
+		if !setRecoveryStatus(app, recovery, RecoveryPending, RecoveryVerified, dbx.Params{
+			"ready_at":          readyAt.Format("2006-01-02 15:04:05.000Z"),
+			"cancel_token_hash": cancelHash,
+		}) {
+			return apis.NewBadRequestError("This recovery has expired. Please start again.", nil)
+		}
+		notifyAccount(authRecord, "Account recovery requested",
+			fmt.Sprintf("Someone verified a request to remove all passkeys from your account. They will be removed after %s UTC. "+
+				"If this wasn't you, cancel it now: %s/webauthn/recovery/cancel?token=%s",
+				readyAt.Format("Jan 2 15:04"), publicURL(), url.QueryEscape(cancelToken)))
+		RecordAuthEvent(app, e, recoveryAuthEvent("passkey_recovery_verified", recovery, map[string]any{"ready_at": readyAt}))
+		return e.JSON(http.StatusOK, map[string]any{"ready_at": readyAt})
+	})
+
+	// linked from the notifications; GET only asks for confirmation so link
+	// scanners can't cancel a recovery
+	sr.GET("/webauthn/recovery/cancel", func(e *core.RequestEvent) error {
+		token := e.Request.URL.Query().Get("token")
+		recovery, err := findRecoveryByCancelToken(app, token)
+		if err != nil {
+			return e.HTML(http.StatusNotFound, "<p>This link is invalid or has already been used.</p>")
+		}
+		if recovery.GetString("status") == RecoveryCompleted {
+			return e.HTML(http.StatusConflict, "<p>This recovery has already completed. Please contact us right away.</p>")
+		}
+		if status := recovery.GetString("status"); status != RecoveryPending && status != RecoveryVerified {
+			return e.HTML(http.StatusOK, "<p>The account recovery has been cancelled. Your passkeys were not changed.</p>")
+		}
+		return e.HTML(http.StatusOK, `<html><body style="font-family:sans-serif;text-align:center;padding:3rem;">`+
+			`<h1>Cancel account recovery</h1><p>Stop the request to remove all passkeys from `+html.EscapeString(recovery.GetString("email"))+`?</p>`+
+			`<form method="POST" action="/webauthn/recovery/cancel?token=`+url.QueryEscape(token)+`">`+
+			`<button type="submit">Cancel recovery</button></form></body></html>`)
+	})
+
+	sr.POST("/webauthn/recovery/cancel", func(e *core.RequestEvent) error {
+		recovery, err := findRecoveryByCancelToken(app, e.Request.URL.Query().Get("token"))
+		if err != nil {
+			return e.HTML(http.StatusNotFound, "<p>This link is invalid or has already been used.</p>")
+		}
+		// conditional, so a cancel racing a completion can't report success
+		res, err := app.DB().Update("passkey_recoveries", dbx.Params{"status": RecoveryCancelled}, dbx.And(
+			dbx.HashExp{"id": recovery.Id},
+			dbx.In("status", RecoveryPending, RecoveryVerified),
+		)).Execute()
+		if err != nil {
+			return apis.NewInternalServerError("Failed to cancel recovery.", err)
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			RecordAuthEvent(app, e, recoveryAuthEvent("passkey_recovery_cancelled", recovery, nil))
+		} else if current, err := app.FindRecordById("passkey_recoveries", recovery.Id); err == nil &&
+			current.GetString("status") == RecoveryCompleted {
+			return e.HTML(http.StatusConflict, "<p>This recovery has already completed. Please contact us right away.</p>")
+		}
+		return e.HTML(http.StatusOK, "<p>The account recovery has been cancelled. Your passkeys were not changed.</p>")
+	})
+
+	sr.POST("/webauthn/recovery/complete", func(e *core.RequestEvent) error {
+		var body struct {
+			RecoveryToken string `json:"recovery_token"`
+		}
+		if err := e.BindBody(&body); err != nil {
+			return apis.NewBadRequestError("Invalid request body.", err)
+		}
+		recovery, err := findRecovery(app, body.RecoveryToken)
+		if err != nil || recovery.GetString("status") != RecoveryVerified {
+			return apis.NewBadRequestError("Invalid recovery.", nil)
+		}
+		readyAt := recovery.GetDateTime("ready_at").Time()
+		if time.Now().Before(readyAt) {
+			return e.JSON(http.StatusConflict, map[string]any{"error": "The cooling-off period has not ended yet", "ready_at": readyAt})
+		}
+		if time.Now().After(readyAt.Add(recoveryCompleteWithin)) {
+			return apis.NewBadRequestError("This recovery has expired. Please start again.", nil)
+		}
+
+		collection := recovery.GetString("collection")
+		if collection != recoveryCollection {
+			return apis.NewBadRequestError("Invalid recovery.", nil)
+		}
+		authRecord, err := app.FindRecordById(collection, recovery.GetString("record"))
+		if err != nil {
+			return apis.NewNotFoundError("User not found.", err)
+		}
+		user, err := FindUser(app, authRecord.Email(), collection)
+		if err != nil {
+			return apis.NewNotFoundError("User not found.", err)
+		}
+		// claimed first, so a cancel that lands now wins or loses cleanly
+		if !setRecoveryStatus(app, recovery, RecoveryVerified, RecoveryCompleted, nil) {
+			return apis.NewBadRequestError("Invalid recovery.", nil)
+		}
+		removed := len(user.WebAuthnCredentials())
+		if err := user.saveWebAuthnCredentials(app, collection, []webauthn.Credential{}, CredentialPBList{}); err != nil {
+			setRecoveryStatus(app, recovery, RecoveryCompleted, RecoveryVerified, nil)
+			return apis.NewInternalServerError("Failed to remove passkeys.", err)
+		}
+		notifyAccount(authRecord, "Your passkeys were removed",
+			"All passkeys were removed from your account through account recovery. If this wasn't you, contact us right away.")
+		RecordAuthEvent(app, e, recoveryAuthEvent("passkey_recovery_completed", recovery, map[string]any{"removed": removed}))
+
+		token, err := newRegistrationToken(authRecord)
+		if err != nil {
+			return apis.NewInternalServerError("Failed to create registration token.", err)
+		}
+		return e.JSON(http.StatusOK, map[string]any{
+			"registration_token": token,
+			"expires":            time.Now().UTC().Add(RegistrationTokenTTL),
+		})
+	})
+}
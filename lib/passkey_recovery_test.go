@@ -0,0 +1,189 @@
+package lib
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+func TestSecretMatches(t *testing.T) {
+	t.Setenv("OTP_SECRET", "test")
+	code := newOTP()
+	if len(code) != 6 {
+		t.Fatalf("expected a six digit code, got %q", code)
+	}
+	hash, err := hashSecret(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !secretMatches(code, hash) {
+		t.Error("code did not match its hash")
+	}
+	if !secretMatches(" "+code+" ", hash) {
+		t.Error("surrounding spaces should be ignored")
+	}
+	if secretMatches("", "") {
+		t.Error("an empty hash must never match")
+	}
+	if secretMatches("000000x", hash) {
+		t.Error("wrong code matched")
+	}
+
+	t.Setenv("OTP_SECRET", "")
+	t.Setenv("shared_secret", "")
+	if _, err := hashSecret(code); err == nil {
+		t.Error("expected hashing to fail without a secret")
+	}
+	if secretMatches(code, hash) {
+		t.Error("nothing should match without a secret")
+	}
+}
+
+func TestPasskeyRecoveryRoutes(t *testing.T) {
+	app, emails := newAuthTestApp(t)
+	t.Setenv("WEBAUTHN_RECOVERY_COOLING_OFF", "1h")
+	handler := testRoutes(t, app, func(r *router.Router[*core.RequestEvent]) {
+		RegisterPasskeyRecoveryRoutes(r, app)
+	})
+	start := func(email string) string {
+		t.Helper()
+		emails.reset()
+		status, body := postJSON(t, handler, "/webauthn/recovery/start", map[string]string{"email": email})
+		if status != http.StatusOK {
+			t.Fatalf("start for %s: status %d, body %v", email, status, body)
+		}
+		return body["recovery_token"].(string)
+	}
+	verify := func(token, code string) int {
+		t.Helper()
+		status, _ := postJSON(t, handler, "/webauthn/recovery/verify", map[string]string{"recovery_token": token, "email_code": code})
+		return status
+	}
+	complete := func(token string) (int, map[string]any) {
+		t.Helper()
+		return postJSON(t, handler, "/webauthn/recovery/complete", map[string]string{"recovery_token": token})
+	}
+	status := func(token string) string {
+		t.Helper()
+		recovery, err := findRecovery(app, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return recovery.GetString("status")
+	}
+	// startVerified runs a recovery up to the cooling-off period and returns
+	// its token and cancel token.
+	startVerified := func(email string) (string, string) {
+		t.Helper()
+		token := start(email)
+		if got := verify(token, emails.code(t, "Your account recovery code")); got != http.StatusOK {
+			t.Fatalf("verify: status %d", got)
+		}
+		match := regexp.MustCompile(`cancel\?token=([A-Za-z0-9]+)`).FindStringSubmatch(emails.waitFor(t, "Account recovery requested").HTMLContent)
+		if match == nil {
+			t.Fatal("no cancel link in the notice")
+		}
+		return token, match[1]
+	}
+	endCoolingOff := func(token string) {
+		t.Helper()
+		hash, _ := hashSecret(token)
+		_, err := app.DB().Update("passkey_recoveries", dbx.Params{"ready_at": time.Now().UTC().Add(-time.Minute).Format("2006-01-02 15:04:05.000Z")},
+			dbx.HashExp{"token_hash": hash}).Execute()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("cooling-off period is enforced", func(t *testing.T) {
+		member := newTestMember(t, app, "cooling@example.com")
+		member.Set(WEBAUTHN_CREDENTIALS_FIELDNAME, `[{"id":"AQID"}]`)
+		if err := app.Save(member); err != nil {
+			t.Fatal(err)
+		}
+		token, _ := startVerified("cooling@example.com")
+		if got, _ := complete(token); got != http.StatusConflict {
+			t.Fatalf("complete during the cooling-off period: status %d", got)
+		}
+		endCoolingOff(token)
+		got, body := complete(token)
+		if got != http.StatusOK {
+			t.Fatalf("complete after the cooling-off period: status %d, body %v", got, body)
+		}
+		if _, ok := body["token"]; ok {
+			t.Error("complete returned a session token")
+		}
+		registered, err := verifyRegistrationToken(app, body["registration_token"].(string))
+		if err != nil || registered.Id != member.Id {
+			t.Fatalf("registration token: %v", err)
+		}
+		member, err = app.FindRecordById("members", member.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if credentials := member.GetString(WEBAUTHN_CREDENTIALS_FIELDNAME); credentials != "[]" {
+			t.Errorf("passkeys were not removed: %s", credentials)
+		}
+	})
+
+	t.Run("cancel wins over complete", func(t *testing.T) {
+		newTestMember(t, app, "cancel@example.com")
+		token, cancelToken := startVerified("cancel@example.com")
+		endCoolingOff(token)
+		if got, _ := postJSON(t, handler, "/webauthn/recovery/cancel?token="+cancelToken, nil); got != http.StatusOK {
+			t.Fatalf("cancel: status %d", got)
+		}
+		if got, _ := complete(token); got != http.StatusBadRequest {
+			t.Errorf("complete after cancel: status %d", got)
+		}
+		if status(token) != RecoveryCancelled {
+			t.Errorf("status = %s", status(token))
+		}
+	})
+
+	t.Run("a new start can't replace a verified recovery", func(t *testing.T) {
+		newTestMember(t, app, "verified@example.com")
+		token, _ := startVerified("verified@example.com")
+		start("verified@example.com")
+		time.Sleep(50 * time.Millisecond)
+		if emails.count("Your account recovery code") != 0 {
+			t.Error("a new code was sent while a recovery is verified")
+		}
+		if status(token) != RecoveryVerified {
+			t.Errorf("status = %s", status(token))
+		}
+	})
+
+	t.Run("attempt cap", func(t *testing.T) {
+		newTestMember(t, app, "guess@example.com")
+		token := start("guess@example.com")
+		code := emails.code(t, "Your account recovery code")
+		wrong := "000000"
+		if code == wrong {
+			wrong = "111111"
+		}
+		for range recoveryMaxAttempts {
+			if got := verify(token, wrong); got != http.StatusBadRequest {
+				t.Fatalf("wrong code: status %d", got)
+			}
+		}
+		if got := verify(token, code); got != http.StatusBadRequest {
+			t.Errorf("the right code verified after the attempt cap: status %d", got)
+		}
+		if status(token) != RecoveryPending {
+			t.Errorf("status = %s", status(token))
+		}
+	})
+
+	t.Run("members only", func(t *testing.T) {
+		got, _ := postJSON(t, handler, "/webauthn/recovery/start", map[string]string{"email": "staff@example.com", "collection": "users"})
+		if got != http.StatusBadRequest {
+			t.Errorf("staff recovery: status %d", got)
+		}
+	})
+}
@@ -0,0 +1,195 @@
+package lib
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"slices"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// knownAuthenticators names common passkey providers by AAGUID. Authenticators
+// not listed show as "Unknown authenticator".
+var knownAuthenticators = map[string]string{
+	"fbfc3007-154e-4ecc-8c0b-6e020557d7bd": "iCloud Keychain",
+	"ea9b8d66-4d01-1d21-3ce4-b6b48cb575d4": "Google Password Manager",
+	"adce0002-35bc-c60a-648b-0b25f1f05503": "Chrome on Mac",
+	"08987058-cadc-4b81-b6e1-30de50dcbe96": "Windows Hello",
+	"9ddd1817-af5a-4672-a2b9-3e3dd95000a9": "Windows Hello",
+	"6028b017-b1d4-4c02-b4b3-afcdafc96bb2": "Windows Hello",
+	"bada5566-a7aa-401f-bd96-45619a55120d": "1Password",
+	"d548826e-79b4-db40-a3d8-11116f7e8349": "Bitwarden",
+	"531126d6-e717-415c-9320-3d9aa6981239": "Dashlane",
+	"0ea242b4-43c4-4a1b-8b17-dd6d0b6baec6": "Keeper",
+}
+
+// Passkey is a stored credential as shown to its owner.
+type Passkey struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Created        string `json:"created"`
+	LastUsed       string `json:"last_used"`
+	AAGUID         string `json:"aaguid"`
+	Authenticator  string `json:"authenticator"`
+	BackupEligible bool   `json:"backup_eligible"`
+	BackedUp       bool   `json:"backed_up"`
+	CloneWarning   bool   `json:"clone_warning"`
+}
+
+// formatAAGUID formats a 16 byte AAGUID as a UUID string.
+func formatAAGUID(b []byte) string {
+	if len(b) != 16 {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func authenticatorName(aaguid string) string {
+	if name, ok := knownAuthenticators[aaguid]; ok {
+		return name
+	}
+	return "Unknown authenticator"
+}
+
+// Passkeys lists the user's credentials with their stored names and usage.
+func (user User) Passkeys() []Passkey {
+	list := user.credentialsList()
+	passkeys := []Passkey{}
+	for _, c := range user.WebAuthnCredentials() {
+		passkeys = append(passkeys, passkeyFromCredential(c, list))
+	}
+	return passkeys
+}
+
+func passkeyFromCredential(c webauthn.Credential, list CredentialPBList) Passkey {
+	aaguid := formatAAGUID(c.Authenticator.AAGUID)
+	passkey := Passkey{
+		ID:             IDString(c),
+		Name:           "unknown",
+		AAGUID:         aaguid,
+		Authenticator:  authenticatorName(aaguid),
+		BackupEligible: c.Flags.BackupEligible,
+		BackedUp:       c.Flags.BackupState,
+		CloneWarning:   c.Authenticator.CloneWarning,
+	}
+	if i := slices.IndexFunc(list, func(m CredentialPB) bool { return m.DeviceID == passkey.ID }); i >= 0 {
+		passkey.Name = list[i].DeviceName
+		passkey.Created = list[i].Created
+		passkey.LastUsed = list[i].LastUsed
+	}
+	return passkey
+}
+
+// Clone policies, set with WEBAUTHN_CLONE_POLICY.
+const (
+	// ClonePolicyReject refuses logins with a credential that raised a clone
+	// warning, now and until an admin deletes it.
+	ClonePolicyReject = "reject"
+	// ClonePolicyFlag lets the login through but flags the credential.
+	ClonePolicyFlag = "flag"
+)
+
+func clonePolicy() string {
+	if os.Getenv("WEBAUTHN_CLONE_POLICY") == ClonePolicyFlag {
+		return ClonePolicyFlag
+	}
+	return ClonePolicyReject
+}
+
+// CompleteWebAuthnLogin checks the credential returned by a successful
+// assertion against the collection's WebAuthnPolicy, stores it and applies the
+// clone policy. The library raises CloneWarning when the sign count didn't go
+// up, which means the private key may exist twice. A new warning is audited,
+// added to the admin notifications and emailed to the security contact; with
+// the reject policy the login fails.
+func CompleteWebAuthnLogin(app *pocketbase.PocketBase, e *core.RequestEvent, user *User, collection string, credential *webauthn.Credential) error {
+	attestationVerified := slices.ContainsFunc(user.credentialsList(), func(c CredentialPB) bool {
+		return c.DeviceID == IDString(*credential) && c.AttestationVerified
+	})
+	if err := LoadWebAuthnPolicy(app, collection).CheckLogin(credential, attestationVerified); err != nil {
+		RecordAuthFailure(app, e, AuthEvent{
+			Event:      "login",
+			Method:     AuthMethodPasskey,
+			Collection: collection,
+			RecordID:   user.Id,
+			Email:      user.Username,
+			Details:    map[string]any{"credential_id": IDString(*credential)},
+		}, err)
+		return apis.NewForbiddenError("This passkey isn't allowed for this account.", err)
+	}
+	flaggedBefore := slices.ContainsFunc(user.WebAuthnCredentials(), func(c webauthn.Credential) bool {
+		return IDString(c) == IDString(*credential) && c.Authenticator.CloneWarning
+	})
+	if flaggedBefore {
+		// keep the flag even if this assertion's count looked fine
+		credential.Authenticator.CloneWarning = true
+	}
+	if err := user.UpdateWebAuthnCredential(app, collection, *credential); err != nil {
+		fmt.Printf("failed to update passkey after login: %v\n", err)
+	}
+	if !credential.Authenticator.CloneWarning {
+		return nil
+	}
+
+	policy := clonePolicy()
+	if !flaggedBefore {
+		outcome := AuthFlagged
+		if policy == ClonePolicyReject {
+			outcome = AuthFailure
+		}
+		RecordAuthEvent(app, e, AuthEvent{
+			Event:      "passkey_clone_warning",
+			Method:     AuthMethodPasskey,
+			Outcome:    outcome,
+			Collection: collection,
+			RecordID:   user.Id,
+			Email:      user.Username,
+			Details: map[string]any{
+				"credential_id": IDString(*credential),
+				"sign_count":    credential.Authenticator.SignCount,
+				"policy":        policy,
+			},
+		})
+		notifyCloneWarning(app, user, collection, *credential, policy)
+	}
+	if policy == ClonePolicyReject {
+		return apis.NewForbiddenError("This passkey has been blocked because it may have been copied. Please sign in another way and remove it.", nil)
+	}
+	return nil
+}
+
+// notifyCloneWarning adds an admin notification for a new clone warning and,
+// when SECURITY_ALERT_EMAIL or REPLY_EMAIL is set, emails it as well.
+func notifyCloneWarning(app core.App, user *User, collection string, credential webauthn.Credential, policy string) {
+	notifications, err := app.FindCollectionByNameOrId("admin_notifications")
+	if err != nil {
+		fmt.Printf("failed to find collection: %v\n", err)
+	} else {
+		notify := core.NewRecord(notifications)
+		notify.Set("message", fmt.Sprintf("A passkey login for %s (%s) raised a clone warning, the sign count (%d) did not increase. Credential %s, policy %s.",
+			user.Username, collection, credential.Authenticator.SignCount, IDString(credential), policy))
+		notify.Set("title", "Possible cloned passkey")
+		notify.Set("color", "red")
+		if err := app.Save(notify); err != nil {
+			fmt.Printf("failed to save clone warning notification: %v\n", err)
+		}
+	}
+
+	to := firstNonEmpty(os.Getenv("SECURITY_ALERT_EMAIL"), os.Getenv("REPLY_EMAIL"))
+	if to == "" {
+		return
+	}
+	message := fmt.Sprintf(
+		"<p>A passkey login for <b>%s</b> (%s) raised a clone warning: the authenticator's sign count (%d) did not increase.</p>"+
+			"<p>Credential: %s<br>Policy: %s</p>",
+		html.EscapeString(user.Username), collection, credential.Authenticator.SignCount, IDString(credential), policy,
+	)
+	err = EmailSender([]Recipient{{Email: to, Name: to}}, "Possible cloned passkey for "+user.Username, message, nil)
+	if err != nil {
+		fmt.Printf("failed to send clone warning: %v\n", err)
+	}
+}
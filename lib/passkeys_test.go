@@ -0,0 +1,20 @@
+package lib
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestFormatAAGUID(t *testing.T) {
+	b, _ := hex.DecodeString("fbfc3007154e4ecc8c0b6e020557d7bd")
+	aaguid := formatAAGUID(b)
+	if aaguid != "fbfc3007-154e-4ecc-8c0b-6e020557d7bd" {
+		t.Fatalf("formatAAGUID = %q", aaguid)
+	}
+	if name := authenticatorName(aaguid); name != "iCloud Keychain" {
+		t.Errorf("authenticatorName = %q", name)
+	}
+	if formatAAGUID(nil) != "" {
+		t.Error("empty AAGUID should format as empty")
+	}
+}
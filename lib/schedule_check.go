@@ -6,12 +6,12 @@ import (
 	"maps"
 	"nmmpocket/openphone"
 	"nmmpocket/zoomcon"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
-	"github.com/pocketbase/pocketbase/tools/template"
 	"github.com/pocketbase/pocketbase/tools/types"
 	"golang.org/x/net/html"
 )
@@ -77,33 +77,57 @@ func zoom_email_send(record *core.Record, app *pocketbase.PocketBase) error {
 	// Fix: Initialize mainParams and properly handle the params
 	mainParams := paramsHelper(record)
 
-	var tos []Recipient
-	subject := emailRecord.GetString("subject")
-	message := emailRecord.GetString("html")
+	category := emailRecord.GetString("category")
+	if IsTransactional(category) {
+		// member-wide blasts are never transactional
+		category = EmailCategoryMarketing
+	}
+	engine := LoadTemplateEngine(app)
+	tpl := MessageTemplateFromRecord(emailRecord)
+
+	// Every member gets the template rendered with their own data and time
+	// zone, so helpers and conditionals see real values. The results go out as
+	// message versions of one send, so it is batched and rate limited.
+	var recipients []Recipient
 	for _, r := range records {
 		errs := app.ExpandRecord(r, []string{"member"}, nil)
 		if len(errs) > 0 {
 			fmt.Printf("failed to expand record %s: %v\n", r.Id, errs)
 			return fmt.Errorf("failed to expand record %s: %v", r.Id, errs)
 		}
-		to := Recipient{
-			Email:     r.ExpandedOne("member").GetString("email"),
-			Name:      r.ExpandedOne("member").GetString("first_name") + " " + r.ExpandedOne("member").GetString("last_name"),
-			FirstName: r.ExpandedOne("member").GetString("first_name"),
-		}
-
-		// Fix: Start with mainParams and then add record-specific params
+		member := r.ExpandedOne("member")
 		paramMap := make(map[string]any)
-		// Copy main params first
 		maps.Copy(paramMap, mainParams)
 		paramMap["join_url"] = r.GetString("join_url")
-		to.Params = &paramMap
-		tos = append(tos, to)
-	}
-	err = EmailSender(tos, subject, message, nil)
+		rendered, err := engine.Render(tpl, recipientTemplateData(paramMap, member), memberLocation(member))
+		if err != nil {
+			return fmt.Errorf("failed to render email template: %w", err)
+		}
+		recipients = append(recipients, Recipient{
+			Email:     member.GetString("email"),
+			Name:      strings.TrimSpace(member.GetString("first_name") + " " + member.GetString("last_name")),
+			FirstName: member.GetString("first_name"),
+			Content:   &rendered,
+		})
+	}
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	// the payload content is only the fallback every version overrides
+	first := recipients[0].Content
+	err = EmailSendPayload(category, recipients, EmailData{
+		Sender:      Contact{Name: os.Getenv("SENDER_NAME"), Email: os.Getenv("SENDER_EMAIL")},
+		ReplyTo:     Contact{Name: os.Getenv("REPLY_NAME"), Email: os.Getenv("REPLY_EMAIL")},
+		Subject:     first.Subject,
+		HTMLContent: first.HTML,
+		TextContent: first.Text,
+	})
 	if err != nil {
-		fmt.Printf("failed to send email: %v\n", err)
-		return err
+		fmt.Printf("failed to send email to %d members: %v\n", len(recipients), err)
+		if !queuedForRetry(err) {
+			return err
+		}
 	}
 	return nil
 }
@@ -229,6 +253,9 @@ func zoomStartLinkHelper(params Recipients, meeting zoomcon.Meeting, record *cor
 	err := EmailSender(tos, subject, message, nil)
 	if err != nil {
 		fmt.Printf("failed to send meeting start email: %v\n", err)
+		if queuedForRetry(err) {
+			return nil
+		}
 		return err
 	}
 	return nil
@@ -287,8 +314,8 @@ func zoom_sms_send(record *core.Record, app *pocketbase.PocketBase) error {
 		return fmt.Errorf("from_number parameter is required and must be a string")
 	}
 
-	// Pre-compile the template once
-	temp := template.NewRegistry().LoadString(HTMLToText(emailRecord.GetString("html")))
+	engine := LoadTemplateEngine(app)
+	tpl := MessageTemplateFromRecord(emailRecord)
 
 	// Track messages for completion
 	var messageCount int
@@ -315,7 +342,9 @@ func zoom_sms_send(record *core.Record, app *pocketbase.PocketBase) error {
 		paramMap["email"] = member.GetString("email")
 
 		// Render the template with the record data
-		text, err := temp.Render(paramMap)
+		data := recipientTemplateData(paramMap, member)
+		data["unsubscribe_url"] = "" // SMS has no unsubscribe link
+		rendered, err := engine.Render(tpl, data, memberLocation(member))
 		if err != nil {
 			fmt.Printf("Failed to execute template for record %d: %v\n", i+1, err)
 			continue
@@ -325,7 +354,7 @@ func zoom_sms_send(record *core.Record, app *pocketbase.PocketBase) error {
 		messageJob := openphone.MessageJob{
 			PhoneNumber: phoneNumber,
 			FromNumber:  fromNumber,
-			Content:     text,
+			Content:     rendered.SMS,
 		}
 
 		messageCount++
@@ -0,0 +1,330 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Scheduled email statuses.
+const (
+	ScheduledEmailPending   = "scheduled"
+	ScheduledEmailSending   = "sending"
+	ScheduledEmailSent      = "sent"
+	ScheduledEmailCancelled = "cancelled"
+	ScheduledEmailFailed    = "failed"
+)
+
+const (
+	// brevoMaxScheduleAhead is how far ahead Brevo accepts scheduledAt.
+	brevoMaxScheduleAhead = 72 * time.Hour
+	// scheduledStuckAfter is how long an internal send may stay "sending"
+	// before it is assumed the process died mid-send and it is marked failed.
+	scheduledStuckAfter = 15 * time.Minute
+)
+
+// ScheduledSender is implemented by providers that can hold an email until
+// scheduledAt themselves and cancel it by batch id.
+type ScheduledSender interface {
+	MaxScheduleAhead() time.Duration
+	CancelScheduled(batchID string) error
+}
+
+func (BrevoProvider) MaxScheduleAhead() time.Duration { return brevoMaxScheduleAhead }
+
+func (BrevoProvider) CancelScheduled(batchID string) error {
+	return BrevoCancelScheduled(batchID)
+}
+
+// ScheduleEmail queues an email for delivery at sendAt and records it in
+// scheduled_emails. When the provider can schedule that far ahead the email is
+// handed over now with scheduledAt and a batch id (suppressions are applied
+// now); otherwise it's kept here and sent by SendDueScheduledEmails. When only
+// some batches reached the provider the record is still saved, with the batch
+// id so it can be cancelled, and returned along with the error.
+func ScheduleEmail(app core.App, category string, to []Recipient, payload EmailData, sendAt time.Time, createdBy string) (*core.Record, error) {
+	sendAt = sendAt.UTC()
+	if !sendAt.After(time.Now()) {
+		return nil, fmt.Errorf("send time must be in the future")
+	}
+	if len(to) == 0 {
+		return nil, fmt.Errorf("no recipients")
+	}
+	collection, err := app.FindCollectionByNameOrId("scheduled_emails")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find collection: %v", err)
+	}
+	record := core.NewRecord(collection)
+	record.Set("category", category)
+	record.Set("subject", payload.Subject)
+	record.Set("send_at", sendAt)
+	record.Set("status", ScheduledEmailPending)
+	record.Set("recipient_count", len(to))
+	record.Set("created_by", createdBy)
+	record.Set("recipients", to)
+	payload.MessageVersions = nil
+	record.Set("payload", payload)
+
+	provider := CurrentEmailProvider()
+	if s, ok := provider.(ScheduledSender); ok && time.Until(sendAt) <= s.MaxScheduleAhead() {
+		at := sendAt.Format(time.RFC3339)
+		payload.ScheduledAt = sendTimeConvert(&at)
+		payload.BatchID = uuid.NewString()
+		record.Set("provider", provider.Name())
+		record.Set("batch_id", payload.BatchID)
+		sendErr := EmailSendPayload(category, to, payload)
+		var partial *PartialSendError
+		switch {
+		case sendErr == nil || queuedForRetry(sendErr):
+			// what failed is retried by the outbox under the same batch id
+		case errors.As(sendErr, &partial):
+			record.Set("error", sendErr.Error())
+			if err := app.Save(record); err != nil {
+				return nil, errors.Join(sendErr, fmt.Errorf("failed to save scheduled email: %v", err))
+			}
+			return record, sendErr
+		default:
+			return nil, sendErr
+		}
+	} else {
+		record.Set("provider", "internal")
+	}
+	if err := app.Save(record); err != nil {
+		return nil, fmt.Errorf("failed to save scheduled email: %v", err)
+	}
+	return record, nil
+}
+
+// CancelScheduledEmail stops a scheduled email that hasn't gone out yet. Parts
+// of it still waiting in the outbox for a retry are cancelled too.
+func CancelScheduledEmail(app core.App, record *core.Record) error {
+	if record.GetString("status") != ScheduledEmailPending {
+		return fmt.Errorf("email is already %s", record.GetString("status"))
+	}
+	if record.GetString("provider") == "internal" {
+		// only while SendDueScheduledEmails hasn't claimed it
+		if !setScheduledStatus(app, record, ScheduledEmailPending, ScheduledEmailCancelled) {
+			return fmt.Errorf("email is already being sent")
+		}
+		return nil
+	}
+	s, ok := CurrentEmailProvider().(ScheduledSender)
+	if !ok || CurrentEmailProvider().Name() != record.GetString("provider") {
+		return fmt.Errorf("email was scheduled with %s, which is no longer the active provider", record.GetString("provider"))
+	}
+	queued, err := CancelOutboxBatch(app, record.GetString("batch_id"))
+	if err != nil {
+		return err
+	}
+	if err := s.CancelScheduled(record.GetString("batch_id")); err != nil {
+		// nothing of the batch reached the provider if it was all queued
+		var apiErr *BrevoAPIError
+		if queued == 0 || !errors.As(err, &apiErr) || apiErr.StatusCode != 404 {
+			return err
+		}
+	}
+	record.Set("status", ScheduledEmailCancelled)
+	return app.Save(record)
+}
+
+// setScheduledStatus moves record from one status to another and reports
+// false when its status was no longer from.
+func setScheduledStatus(app core.App, record *core.Record, from, to string) bool {
+	res, err := app.DB().Update("scheduled_emails", dbx.Params{
+		"status":  to,
+		"updated": types.NowDateTime().String(),
+	}, dbx.HashExp{"id": record.Id, "status": from}).Execute()
+	if err != nil {
+		log.Default().Println(fmt.Errorf("failed to update scheduled email %s: %w", record.Id, err))
+		return false
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return false
+	}
+	record.Set("status", to)
+	return true
+}
+
+// failStuckScheduledEmails gives up on internal sends left "sending" by a
+// process that stopped mid-send. They may have gone out already, so they
+// aren't sent again.
+func failStuckScheduledEmails(app core.App, now time.Time) {
+	_, err := app.DB().Update("scheduled_emails", dbx.Params{
+		"status": ScheduledEmailFailed,
+		"error":  "interrupted while sending, it may or may not have been delivered",
+	}, dbx.And(
+		dbx.HashExp{"status": ScheduledEmailSending},
+		dbx.NewExp("updated <= {:stuck}", dbx.Params{"stuck": now.Add(-scheduledStuckAfter).Format("2006-01-02 15:04:05.000Z")}),
+	)).Execute()
+	if err != nil {
+		log.Default().Println(fmt.Errorf("failed to update stuck scheduled emails: %w", err))
+	}
+}
+
+// SendDueScheduledEmails sends internally scheduled emails whose time has
+// come. It runs every minute from cron.
+func SendDueScheduledEmails(app core.App) {
+	failStuckScheduledEmails(app, time.Now().UTC())
+	records, err := app.FindRecordsByFilter(
+		"scheduled_emails",
+		"status = {:status} && provider = 'internal' && send_at <= {:now}",
+		"send_at",
+		0,
+		0,
+		dbx.Params{"status": ScheduledEmailPending, "now": time.Now().UTC().Format("2006-01-02 15:04:05.000Z")},
+	)
+	if err != nil {
+		log.Default().Println(fmt.Errorf("failed to load scheduled emails: %w", err))
+		return
+	}
+	for _, record := range records {
+		// claimed one at a time, so a run that overlaps a slow one skips the
+		// emails it already sent or is sending
+		if !setScheduledStatus(app, record, ScheduledEmailPending, ScheduledEmailSending) {
+			continue
+		}
+		var to []Recipient
+		var payload EmailData
+		err := record.UnmarshalJSONField("recipients", &to)
+		if err == nil {
+			err = record.UnmarshalJSONField("payload", &payload)
+		}
+		if err == nil {
+			err = EmailSendPayload(record.GetString("category"), to, payload)
+		}
+		if err != nil {
+			log.Default().Println(fmt.Errorf("failed to send scheduled email %s: %w", record.Id, err))
+			record.Set("error", err.Error())
+		}
+		if err != nil && !queuedForRetry(err) {
+			record.Set("status", ScheduledEmailFailed)
+		} else {
+			record.Set("status", ScheduledEmailSent)
+			record.Set("sent_at", time.Now().UTC())
+		}
+		if err := app.Save(record); err != nil {
+			log.Default().Println(fmt.Errorf("failed to update scheduled email %s: %w", record.Id, err))
+		}
+	}
+}
+
+// ScheduledEmailRoute queues an email. The body is
+//
+//	{"category": "marketing", "subject": "...", "html": "...", "text": "...",
+//	 "send_at": "2026-01-02T15:00:00Z",
+//	 "recipients": [{"email": "...", "name": "...", "first_name": "...", "params": {...}}],
+//	 "filter": "<members filter>"}
+//
+// Recipients come from the list, the members matching filter, or both. The
+// category defaults to marketing, so opt-outs and unsubscribe links apply. The
+// html may use {{params.x}}. Only staff accounts from the users collection
+// may call it.
+func ScheduledEmailRoute(e *core.RequestEvent) error {
+	if e.Auth.Collection().Name != "users" {
+		return e.JSON(403, map[string]string{"error": "Unauthorized"})
+	}
+	var body struct {
+		Category   string `json:"category"`
+		Subject    string `json:"subject"`
+		HTML       string `json:"html"`
+		Text       string `json:"text"`
+		SendAt     string `json:"send_at"`
+		Filter     string `json:"filter"`
+		Recipients []struct {
+			Email     string         `json:"email"`
+			Name      string         `json:"name"`
+			FirstName string         `json:"first_name"`
+			Params    map[string]any `json:"params"`
+		} `json:"recipients"`
+	}
+	if err := e.BindBody(&body); err != nil {
+		return e.JSON(400, map[string]string{"error": "Invalid request body"})
+	}
+	sendAt, err := time.Parse(time.RFC3339, body.SendAt)
+	if err != nil {
+		return e.JSON(400, map[string]string{"error": "send_at must be an RFC3339 time"})
+	}
+	if body.Subject == "" || (body.HTML == "" && body.Text == "") {
+		return e.JSON(400, map[string]string{"error": "subject and html or text are required"})
+	}
+
+	var to []Recipient
+	for _, r := range body.Recipients {
+		recipient := Recipient{Email: r.Email, Name: firstNonEmpty(r.Name, r.Email), FirstName: r.FirstName}
+		if r.Params != nil {
+			recipient.Params = &r.Params
+		}
+		to = append(to, recipient)
+	}
+	if body.Filter != "" {
+		members, err := e.App.FindRecordsByFilter("members", body.Filter, "", 0, 0)
+		if err != nil {
+			return e.JSON(400, map[string]string{"error": "Invalid members filter"})
+		}
+		for _, m := range members {
+			to = append(to, Recipient{
+				Email:     m.GetString("email"),
+				Name:      strings.TrimSpace(m.GetString("first_name") + " " + m.GetString("last_name")),
+				FirstName: m.GetString("first_name"),
+			})
+		}
+	}
+
+	record, err := ScheduleEmail(e.App, firstNonEmpty(body.Category, EmailCategoryMarketing), to, EmailData{
+		Sender:      Contact{Name: os.Getenv("SENDER_NAME"), Email: os.Getenv("SENDER_EMAIL")},
+		ReplyTo:     Contact{Name: os.Getenv("REPLY_NAME"), Email: os.Getenv("REPLY_EMAIL")},
+		Subject:     body.Subject,
+		HTMLContent: body.HTML,
+		TextContent: body.Text,
+	}, sendAt, e.Auth.Id)
+	if err != nil && record != nil {
+		// scheduled for some recipients only
+		return e.JSON(502, map[string]any{"error": err.Error(), "scheduled": record})
+	}
+	if err != nil {
+		return e.JSON(400, map[string]string{"error": err.Error()})
+	}
+	return e.JSON(200, record)
+}
+
+// ScheduledEmailListRoute lists scheduled emails, soonest first. ?status=
+// filters by status.
+func ScheduledEmailListRoute(e *core.RequestEvent) error {
+	if e.Auth.Collection().Name != "users" {
+		return e.JSON(403, map[string]string{"error": "Unauthorized"})
+	}
+	filter := "id != ''"
+	params := dbx.Params{}
+	if status := e.Request.URL.Query().Get("status"); status != "" {
+		filter = "status = {:status}"
+		params["status"] = status
+	}
+	records, err := e.App.FindRecordsByFilter("scheduled_emails", filter, "send_at", 200, 0, params)
+	if err != nil {
+		return e.JSON(500, map[string]string{"error": "Failed to load scheduled emails"})
+	}
+	return e.JSON(200, map[string]any{"items": records})
+}
+
+// ScheduledEmailCancelRoute cancels a scheduled email.
+func ScheduledEmailCancelRoute(e *core.RequestEvent) error {
+	if e.Auth.Collection().Name != "users" {
+		return e.JSON(403, map[string]string{"error": "Unauthorized"})
+	}
+	record, err := e.App.FindRecordById("scheduled_emails", e.Request.PathValue("id"))
+	if err != nil {
+		return e.JSON(404, map[string]string{"error": "Scheduled email not found"})
+	}
+	if err := CancelScheduledEmail(e.App, record); err != nil {
+		return e.JSON(409, map[string]string{"error": err.Error()})
+	}
+	return e.JSON(200, record)
+}
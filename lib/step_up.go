@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/hook"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+// CeremonyStepUp is the ceremony kind of a step-up assertion.
+const CeremonyStepUp = "step_up"
+
+const (
+	stepUpTokenType = "step_up"
+	// StepUpHeader carries the step-up token on protected requests.
+	StepUpHeader = "X-Step-Up-Token"
+	// StepUpTTL is how long a step-up lasts.
+	StepUpTTL = 5 * time.Minute
+)
+
+// stepUpKey signs step-up tokens. It derives from the record's token key, so a
+// password change or logout-all voids outstanding step-ups too.
+func stepUpKey(record *core.Record) string {
+	return record.TokenKey() + record.Collection().AuthToken.Secret + stepUpTokenType
+}
+
+// NewStepUpToken issues the elevated claim for record.
+func NewStepUpToken(record *core.Record) (string, error) {
+	return security.NewJWT(jwt.MapClaims{
+		"id":           record.Id,
+		"collectionId": record.Collection().Id,
+		"type":         stepUpTokenType,
+	}, stepUpKey(record), StepUpTTL)
+}
+
+// VerifyStepUpToken reports whether token is a valid step-up for record.
+func VerifyStepUpToken(record *core.Record, token string) bool {
+	if record == nil || token == "" {
+		return false
+	}
+	claims, err := security.ParseJWT(token, stepUpKey(record))
+	if err != nil {
+		return false
+	}
+	return claims["type"] == stepUpTokenType &&
+		claims["id"] == record.Id &&
+		claims["collectionId"] == record.Collection().Id
+}
+
+// RequireStepUp only lets requests through that carry a step-up token for the
+// authenticated record in the X-Step-Up-Token header. Bind it after
+// apis.RequireAuth.
+func RequireStepUp() *hook.Handler[*core.RequestEvent] {
+	return &hook.Handler[*core.RequestEvent]{
+		Id: "requireStepUp",
+		Func: func(e *core.RequestEvent) error {
+			if e.Auth == nil {
+				return apis.NewUnauthorizedError("The request requires valid record authorization token.", nil)
+			}
+			if !VerifyStepUpToken(e.Auth, e.Request.Header.Get(StepUpHeader)) {
+				return e.JSON(http.StatusForbidden, map[string]string{
+					"error":   "Step-up authentication required",
+					"step_up": "/webauthn/step-up",
+				})
+			}
+			return e.Next()
+		},
+	}
+}
+
+// RequireStepUpIfEnrolled is RequireStepUp for accounts that have a passkey.
+// Accounts without one can't step up, so they pass with a normal token; this
+// lets the first passkey be registered while stopping a stolen token from
+// adding a passkey of its own to an account that already has one.
+func RequireStepUpIfEnrolled() *hook.Handler[*core.RequestEvent] {
+	requireStepUp := RequireStepUp()
+	return &hook.Handler[*core.RequestEvent]{
+		Id: "requireStepUpIfEnrolled",
+		Func: func(e *core.RequestEvent) error {
+			if e.Auth == nil {
+				return apis.NewUnauthorizedError("The request requires valid record authorization token.", nil)
+			}
+			credentials := e.Auth.GetString(WEBAUTHN_CREDENTIALS_FIELDNAME)
+			if len((User{WebAuthnCredentialsJSON: &credentials}).WebAuthnCredentials()) == 0 {
+				return e.Next()
+			}
+			return requireStepUp.Func(e)
+		},
+	}
+}
+
+// RegisterStepUpRoutes registers the step-up ceremony. The client asks for a
+// challenge, has the user verify with a passkey (PIN or biometrics, not just
+// presence) and gets back a token that is valid for StepUpTTL.
+func RegisterStepUpRoutes(sr *router.Router[*core.RequestEvent], app *pocketbase.PocketBase, webAuthn *webauthn.WebAuthn, sessions WebAuthnSessionStore) {
+	sr.POST("/webauthn/step-up", func(e *core.RequestEvent) error {
+		user, err := FindUser(app, e.Auth.Email(), e.Auth.Collection().Name)
+		if err != nil {
+			return apis.NewNotFoundError("User not found.", err)
+		}
+		if len(user.WebAuthnCredentials()) == 0 {
+			return apis.NewBadRequestError("Register a passkey first.", nil)
+		}
+		options, sessionData, err := webAuthn.BeginLogin(user, webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			return apis.NewBadRequestError("Failed to start step-up.", err)
+		}
+		ceremonyID, err := sessions.Save(CeremonyStepUp, sessionData)
+		if err != nil {
+			return apis.NewInternalServerError("Failed to store session data.", err)
+		}
+		return CeremonyResponse(e, ceremonyID, options)
+	}).Bind(apis.RequireAuth())
+
+	sr.POST("/webauthn/step-up/finish", func(e *core.RequestEvent) error {
+		collection := e.Auth.Collection().Name
+		user, err := FindUser(app, e.Auth.Email(), collection)
+		if err != nil {
+			return apis.NewNotFoundError("User not found.", err)
+		}
+		sessionData, err := sessions.Consume(CeremonyStepUp, CeremonyID(e))
+		if err != nil {
+			return apis.NewBadRequestError("Invalid session data.", err)
+		}
+		io.ReadAll(e.Request.Body)
+		event := AuthEvent{
+			Event:      "step_up",
+			Method:     AuthMethodPasskey,
+			Collection: collection,
+			RecordID:   user.Id,
+			Email:      user.Username,
+		}
+		credential, err := webAuthn.FinishLogin(user, *sessionData, e.Request)
+		if err != nil {
+			RecordAuthFailure(app, e, event, err)
+			return apis.NewBadRequestError("Failed to finish step-up.", err)
+		}
+		if err := CompleteWebAuthnLogin(app, e, user, collection, credential); err != nil {
+			return err
+		}
+		token, err := NewStepUpToken(e.Auth)
+		if err != nil {
+			return apis.NewInternalServerError("Failed to create step-up token.", err)
+		}
+		RecordAuthEvent(app, e, event)
+		return e.JSON(http.StatusOK, map[string]any{
+			"step_up_token": token,
+			"expires":       time.Now().UTC().Add(StepUpTTL),
+		})
+	}).Bind(apis.RequireAuth())
+}
@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func TestStepUpToken(t *testing.T) {
+	collection := core.NewAuthCollection("members")
+	collection.AuthToken.Secret = "secret"
+	record := core.NewRecord(collection)
+	record.Id = "member1"
+	record.RefreshTokenKey()
+
+	token, err := NewStepUpToken(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyStepUpToken(record, token) {
+		t.Fatal("expected token to verify")
+	}
+
+	other := core.NewRecord(collection)
+	other.Id = "member2"
+	other.SetTokenKey(record.TokenKey())
+	if VerifyStepUpToken(other, token) {
+		t.Error("token verified for another record")
+	}
+
+	record.RefreshTokenKey()
+	if VerifyStepUpToken(record, token) {
+		t.Error("token verified after the token key changed")
+	}
+	if VerifyStepUpToken(record, "") {
+		t.Error("empty token verified")
+	}
+}
+
+func TestRequireStepUpIfEnrolled(t *testing.T) {
+	collection := core.NewAuthCollection("members")
+	collection.AuthToken.Secret = "secret"
+	record := core.NewRecord(collection)
+	record.Id = "member1"
+	record.RefreshTokenKey()
+
+	run := func(token string) error {
+		e := &core.RequestEvent{}
+		e.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+		e.Response = httptest.NewRecorder()
+		e.Auth = record
+		if token != "" {
+			e.Request.Header.Set(StepUpHeader, token)
+		}
+		return RequireStepUpIfEnrolled().Func(e)
+	}
+
+	if err := run(""); err != nil {
+		t.Fatalf("account without passkeys: unexpected error %v", err)
+	}
+
+	record.Set(WEBAUTHN_CREDENTIALS_FIELDNAME, `[{"id":"AQID"}]`)
+	rec := httptest.NewRecorder()
+	e := &core.RequestEvent{}
+	e.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+	e.Response = rec
+	e.Auth = record
+	if err := RequireStepUpIfEnrolled().Func(e); err != nil || rec.Code != http.StatusForbidden {
+		t.Fatalf("account with a passkey and no step-up: got %v, status %d", err, rec.Code)
+	}
+
+	token, err := NewStepUpToken(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(token); err != nil {
+		t.Fatalf("account with a passkey and a step-up: unexpected error %v", err)
+	}
+}
@@ -17,6 +17,7 @@ import (
 // Register a stripe webhook
 func RegisterStripeWebhook(sr *router.Router[*core.RequestEvent], app *pocketbase.PocketBase) {
 	sr.GET("/stripe/invoice/{invoiceID}", generate_link_invoice)
+	sr.POST("/stripe/invoice/{invoiceID}/payment", InvoicePaymentRoute)
 	sr.POST("/stripe/webhook", func(e *core.RequestEvent) error {
 		event := &stripe.Event{}
 
@@ -33,6 +34,13 @@ func RegisterStripeWebhook(sr *router.Router[*core.RequestEvent], app *pocketbas
 			} else {
 				return e.JSON(http.StatusOK, map[string]string{"status": "failed"})
 			}
+		case "payment_intent.payment_failed":
+			// Record the failed outcome so autopay success can be reported
+			if processIntentFailed(event, app) {
+				return e.JSON(http.StatusOK, map[string]string{"status": "success"})
+			} else {
+				return e.JSON(http.StatusOK, map[string]string{"status": "failed"})
+			}
 		case "checkout.session.completed":
 			// Handle successful checkout
 			if processIntentSucceded(event, app) {
@@ -46,6 +54,37 @@ func RegisterStripeWebhook(sr *router.Router[*core.RequestEvent], app *pocketbas
 	})
 }
 
+// recordAutopayAttempt keeps the outcome of every autopay charge in
+// autopay_attempts (invoice, payment_intent, event_id, status, amount, error)
+// for the finance dashboard. Other payments and redelivered events are skipped.
+func recordAutopayAttempt(app *pocketbase.PocketBase, event *stripe.Event, status, message string) {
+	intent := event.Data.Object
+	metadata, _ := intent["metadata"].(map[string]any)
+	if event.Type == "checkout.session.completed" || metadata["autopay"] != "true" {
+		return
+	}
+	if _, err := app.FindFirstRecordByData("autopay_attempts", "event_id", event.ID); err == nil {
+		return
+	}
+	collection, err := app.FindCollectionByNameOrId("autopay_attempts")
+	if err != nil {
+		log.Default().Println(fmt.Errorf("failed to find collection: %v", err))
+		return
+	}
+	attempt := core.NewRecord(collection)
+	attempt.Set("invoice", metadata["invoice_id"])
+	attempt.Set("payment_intent", intent["id"])
+	attempt.Set("event_id", event.ID)
+	attempt.Set("status", status)
+	if amount, ok := intent["amount"].(float64); ok {
+		attempt.Set("amount", amount/100)
+	}
+	attempt.Set("error", message)
+	if err := app.Save(attempt); err != nil {
+		log.Default().Println(fmt.Errorf("failed to save autopay attempt: %v", err))
+	}
+}
+
 func processIntentSucceded(event *stripe.Event, app *pocketbase.PocketBase) bool {
 	intent := event.Data.Object
 	//check is metadata is present and contains a type field
@@ -56,6 +95,7 @@ func processIntentSucceded(event *stripe.Event, app *pocketbase.PocketBase) bool
 	if metadata["type"] == nil {
 		return false
 	}
+	recordAutopayAttempt(app, event, "succeeded", "")
 	if metadata["type"] == "invoice" {
 		err := invoiceResponseProcess(intent, app)
 		if err != nil {
@@ -66,14 +106,62 @@ func processIntentSucceded(event *stripe.Event, app *pocketbase.PocketBase) bool
 	return true
 }
 
-func invoiceResponseProcess(data map[string]any, app *pocketbase.PocketBase) error {
+func processIntentFailed(event *stripe.Event, app *pocketbase.PocketBase) bool {
+	intent := event.Data.Object
+	metadata, ok := intent["metadata"].(map[string]any)
+	if !ok || metadata["type"] != "invoice" {
+		return false
+	}
+	record, err := findInvoiceForIntent(intent, app)
+	if err != nil {
+		log.Default().Println(err)
+		return false
+	}
+	message := ""
+	if lastErr, ok := intent["last_payment_error"].(map[string]any); ok {
+		message, _ = lastErr["message"].(string)
+	}
+	recordAutopayAttempt(app, event, "failed", message)
+	record.Set("payment_status", "failed")
+	record.Set("payment_error", message)
+	if err := app.Save(record); err != nil {
+		log.Default().Println(fmt.Errorf("failed to save invoice: %v", err))
+		return false
+	}
+	return true
+}
+
+// findInvoiceForIntent finds the invoice for a webhook object, using the
+// invoice_id metadata when present and the stored session id otherwise.
+func findInvoiceForIntent(data map[string]any, app *pocketbase.PocketBase) (*core.Record, error) {
+	if metadata, ok := data["metadata"].(map[string]any); ok {
+		if invoiceID, ok := metadata["invoice_id"].(string); ok && invoiceID != "" {
+			if record, err := app.FindRecordById("invoices", invoiceID); err == nil {
+				return record, nil
+			}
+		}
+	}
 	record, err := app.FindFirstRecordByData("invoices", "session", data["id"].(string))
 	if err != nil {
-		return fmt.Errorf("failed to find invoice: %v", err)
+		return nil, fmt.Errorf("failed to find invoice: %v", err)
+	}
+	return record, nil
+}
+
+func invoiceResponseProcess(data map[string]any, app *pocketbase.PocketBase) error {
+	record, err := findInvoiceForIntent(data, app)
+	if err != nil {
+		return err
 	}
 	record.Set("paid", true)
 	//set paid date to now in 2022-01-01 10:00:00.123Z format
 	record.Set("paid_date", time.Now().Format(time.RFC3339))
+	record.Set("payment_status", "succeeded")
+	paidVia := "manual"
+	if metadata, ok := data["metadata"].(map[string]any); ok && metadata["autopay"] == "true" {
+		paidVia = "autopay"
+	}
+	record.Set("paid_via", paidVia)
 	err = app.Save(record)
 	if err != nil {
 		return fmt.Errorf("failed to save invoice: %v", err)
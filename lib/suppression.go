@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Email categories. Transactional mail (password resets, invoices, meeting
+// start links) is only blocked by suppressions with the "all" scope; every
+// other category is treated as marketing.
+const (
+	EmailCategoryTransactional = "transactional"
+	EmailCategoryMarketing     = "marketing"
+)
+
+// Suppression scopes.
+const (
+	SuppressionScopeMarketing = "marketing"
+	SuppressionScopeAll       = "all"
+)
+
+// emailApp is the app the send path uses to read suppressions and member
+// email preferences. It is set by InitEmailProvider; without it nothing is
+// filtered.
+var emailApp core.App
+
+// IsTransactional reports whether a category is transactional. An empty
+// category is transactional so existing send paths keep working.
+func IsTransactional(category string) bool {
+	return category == "" || category == EmailCategoryTransactional
+}
+
+// suppressedEmails returns the lowercased addresses among emails that must not
+// receive a message of the given category.
+func suppressedEmails(category string, emails []string) (map[string]string, error) {
+	suppressed := map[string]string{}
+	if emailApp == nil || len(emails) == 0 {
+		return suppressed, nil
+	}
+	values := make([]any, len(emails))
+	for i, e := range emails {
+		values[i] = strings.ToLower(strings.TrimSpace(e))
+	}
+	var rows []struct {
+		Email  string `db:"email"`
+		Scope  string `db:"scope"`
+		Reason string `db:"reason"`
+	}
+	err := emailApp.DB().Select("email", "scope", "reason").
+		From("email_suppressions").
+		Where(dbx.In("LOWER(email)", values...)).
+		All(&rows)
+	if err != nil {
+		return suppressed, fmt.Errorf("failed to load email suppressions: %w", err)
+	}
+	for _, row := range rows {
+		if row.Scope == SuppressionScopeAll || !IsTransactional(category) {
+			suppressed[strings.ToLower(row.Email)] = row.Reason
+		}
+	}
+	return suppressed, nil
+}
+
+// FilterRecipients drops recipients that must not get an email of the given
+// category, either because they are suppressed or because they opted out.
+func FilterRecipients(category string, to []Recipient) []Recipient {
+	return filterOptedOut(category, filterSuppressedRecipients(category, to))
+}
+
+// filterSuppressedRecipients drops suppressed recipients (and suppressed CCs
+// and BCCs) for the category and logs each one that was skipped. If the
+// suppression list can't be read the recipients are returned unchanged.
+func filterSuppressedRecipients(category string, to []Recipient) []Recipient {
+	var emails []string
+	for _, r := range to {
+		emails = append(emails, r.Email)
+		for _, c := range slices.Concat(r.CC, r.BCC) {
+			if email, ok := c["email"].(string); ok {
+				emails = append(emails, email)
+			}
+		}
+	}
+	suppressed, err := suppressedEmails(category, emails)
+	if err != nil {
+		log.Default().Println(err)
+		return to
+	}
+	if len(suppressed) == 0 {
+		return to
+	}
+
+	var allowed []Recipient
+	for _, r := range to {
+		if reason, ok := suppressed[strings.ToLower(r.Email)]; ok {
+			log.Default().Printf("Skipping suppressed recipient %s (%s, %s email)\n", r.Email, reason, categoryOrDefault(category))
+			continue
+		}
+		r.CC = filterSuppressedCopies("cc", category, r.CC, suppressed)
+		r.BCC = filterSuppressedCopies("bcc", category, r.BCC, suppressed)
+		allowed = append(allowed, r)
+	}
+	return allowed
+}
+
+func filterSuppressedCopies(kind, category string, copies []map[string]any, suppressed map[string]string) []map[string]any {
+	var allowed []map[string]any
+	for _, c := range copies {
+		email, _ := c["email"].(string)
+		if reason, ok := suppressed[strings.ToLower(email)]; ok {
+			log.Default().Printf("Skipping suppressed %s %s (%s, %s email)\n", kind, email, reason, categoryOrDefault(category))
+			continue
+		}
+		allowed = append(allowed, c)
+	}
+	return allowed
+}
+
+func categoryOrDefault(category string) string {
+	if category == "" {
+		return EmailCategoryTransactional
+	}
+	return category
+}
+
+// AddSuppression adds an address to the suppression list, or updates the
+// reason and scope of an existing entry. Automatic entries from bounces and
+// complaints use the marketing scope so transactional mail still goes out.
+func AddSuppression(app core.App, email, reason, scope, source string) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return nil
+	}
+	// entries added from the dashboard may not be lowercased yet
+	record := &core.Record{}
+	err := app.RecordQuery("email_suppressions").
+		AndWhere(dbx.NewExp("LOWER(email) = {:email}", dbx.Params{"email": email})).
+		Limit(1).
+		One(record)
+	if err != nil {
+		collection, err := app.FindCollectionByNameOrId("email_suppressions")
+		if err != nil {
+			return fmt.Errorf("failed to find collection: %v", err)
+		}
+		record = core.NewRecord(collection)
+	} else if record.GetString("scope") == SuppressionScopeAll {
+		// never narrow a suppression that was set to block everything
+		scope = SuppressionScopeAll
+	}
+	record.Set("email", email)
+	record.Set("reason", reason)
+	record.Set("scope", scope)
+	record.Set("source", source)
+	return app.Save(record)
+}
@@ -0,0 +1,201 @@
+package lib
+
+import (
+	"fmt"
+	"maps"
+	"nmmpocket/openphone"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// gsm7Chars is the GSM 03.38 basic character set; gsm7ExtChars take two
+// septets. Anything else forces UCS-2.
+const (
+	gsm7Chars    = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	gsm7ExtChars = "^{}\\[~]|€\f"
+)
+
+// SMSSegments returns how many SMS segments text needs and the encoding used.
+func SMSSegments(text string) (int, string) {
+	if text == "" {
+		return 0, "GSM-7"
+	}
+	septets := 0
+	gsm := true
+	for _, r := range text {
+		switch {
+		case strings.ContainsRune(gsm7Chars, r):
+			septets++
+		case strings.ContainsRune(gsm7ExtChars, r):
+			septets += 2
+		default:
+			gsm = false
+		}
+	}
+	if gsm {
+		if septets <= 160 {
+			return 1, "GSM-7"
+		}
+		return (septets + 152) / 153, "GSM-7"
+	}
+	// UCS-2 counts UTF-16 code units
+	units := 0
+	for _, r := range text {
+		if r > 0xFFFF {
+			units += 2
+		} else {
+			units++
+		}
+	}
+	if units <= 70 {
+		return 1, "UCS-2"
+	}
+	return (units + 66) / 67, "UCS-2"
+}
+
+// sampleTemplateData fills every variable a template may use with a
+// placeholder value so staff can see the layout without a real record.
+func sampleTemplateData(tpl MessageTemplate) map[string]any {
+	now := time.Now().UTC()
+	data := map[string]any{
+		"name":            "Jane Member",
+		"email":           "jane@example.com",
+		"first_name":      "Jane",
+		"last_name":       "Member",
+		"unsubscribe_url": "#",
+		"join_url":        publicURL() + "/z/m/sample",
+		"start_url":       "https://zoom.us/s/0000000000",
+		"topic":           "Monthly Mastermind",
+		"start_time":      now.Add(24 * time.Hour).Format(time.RFC3339),
+		"start_time_est":  formatEasternTime(now.Add(24 * time.Hour)),
+		"link_expires_at": formatEasternTime(now.Add(120 * time.Minute)),
+		"duration":        60,
+		"from_number":     "+15555550100",
+		"ID":              "sampleinvoice01",
+		"Name":            "Jane Member",
+		"Email":           "jane@example.com",
+		"InvoiceName":     "Membership dues",
+		"Description":     "Monthly membership",
+		"Amount":          "150.00",
+		"DueDate":         now.AddDate(0, 0, 5).Format("Jan 2, 2006"),
+		"LateFee":         "0.00",
+		"is_auto_pay":     "",
+	}
+	for _, v := range tpl.Variables {
+		if _, ok := data[v]; !ok {
+			data[v] = "[" + v + "]"
+		}
+	}
+	return data
+}
+
+// TemplatePreviewRoute renders an email_template or email_basic record and
+// optionally sends a test copy to the logged-in staff member. The body is
+//
+//	{"member": "<id>", "invoice": "<id>", "params": {...},
+//	 "send_email": true, "send_sms": true, "from_number": "+1..."}
+//
+// where every field is optional. Without a member or invoice, sample data is
+// used. Only staff accounts from the users collection may call it.
+func TemplatePreviewRoute(e *core.RequestEvent) error {
+	if e.Auth.Collection().Name != "users" {
+		return e.JSON(403, map[string]string{"error": "Unauthorized"})
+	}
+	collection := e.Request.PathValue("collection")
+	if collection != "email_template" && collection != "email_basic" {
+		return e.JSON(400, map[string]string{"error": "collection must be email_template or email_basic"})
+	}
+	var body struct {
+		Member     string         `json:"member"`
+		Invoice    string         `json:"invoice"`
+		Params     map[string]any `json:"params"`
+		SendEmail  bool           `json:"send_email"`
+		SendSMS    bool           `json:"send_sms"`
+		FromNumber string         `json:"from_number"`
+	}
+	if err := e.BindBody(&body); err != nil {
+		return e.JSON(400, map[string]string{"error": "Invalid request body"})
+	}
+	record, err := e.App.FindRecordById(collection, e.Request.PathValue("id"))
+	if err != nil {
+		return e.JSON(404, map[string]string{"error": "Template not found"})
+	}
+
+	tpl := MessageTemplateFromRecord(record)
+	data := sampleTemplateData(tpl)
+	var loc *time.Location
+	if body.Member != "" {
+		member, err := e.App.FindRecordById("members", body.Member)
+		if err != nil {
+			return e.JSON(404, map[string]string{"error": "Member not found"})
+		}
+		maps.Copy(data, recipientTemplateData(nil, member))
+		data["unsubscribe_url"] = "#"
+		loc = memberLocation(member)
+	}
+	if body.Invoice != "" {
+		var invoice Invoice
+		err := e.App.DB().Select("*").From("invoices").Where(dbx.HashExp{"id": body.Invoice}).One(&invoice)
+		if err != nil {
+			return e.JSON(404, map[string]string{"error": "Invoice not found"})
+		}
+		maps.Copy(data, invoiceTemplateData(invoice))
+	}
+	maps.Copy(data, body.Params)
+
+	engine := LoadTemplateEngine(e.App)
+	unknown, err := engine.Validate(tpl)
+	if err != nil {
+		return e.JSON(400, map[string]string{"error": err.Error()})
+	}
+	rendered, err := engine.Render(tpl, data, loc)
+	if err != nil {
+		return e.JSON(400, map[string]string{"error": err.Error()})
+	}
+	segments, encoding := SMSSegments(rendered.SMS)
+	result := map[string]any{
+		"subject":           rendered.Subject,
+		"html":              rendered.HTML,
+		"text":              rendered.Text,
+		"sms":               rendered.SMS,
+		"sms_segments":      segments,
+		"sms_encoding":      encoding,
+		"unknown_variables": unknown,
+	}
+
+	if body.SendEmail {
+		err := EmailSendPayload(EmailCategoryTransactional, []Recipient{{
+			Email:     e.Auth.Email(),
+			Name:      firstNonEmpty(e.Auth.GetString("name"), e.Auth.Email()),
+			FirstName: e.Auth.GetString("name"),
+		}}, EmailData{
+			Sender:      Contact{Name: os.Getenv("SENDER_NAME"), Email: os.Getenv("SENDER_EMAIL")},
+			ReplyTo:     Contact{Name: os.Getenv("REPLY_NAME"), Email: os.Getenv("REPLY_EMAIL")},
+			Subject:     "[Test] " + rendered.Subject,
+			HTMLContent: rendered.HTML,
+			TextContent: rendered.Text,
+		})
+		if err != nil {
+			return e.JSON(500, map[string]string{"error": fmt.Sprintf("Failed to send test email: %v", err)})
+		}
+		result["email_sent_to"] = e.Auth.Email()
+	}
+	if body.SendSMS {
+		phone := e.Auth.GetString("phone")
+		fromNumber := firstNonEmpty(body.FromNumber, os.Getenv("OPENPHONE_FROM_NUMBER"))
+		if phone == "" || fromNumber == "" {
+			return e.JSON(400, map[string]string{"error": "A phone number on your account and a from_number are required to send a test SMS"})
+		}
+		openphone.Enqueue(openphone.MessageJob{
+			PhoneNumber: phone,
+			FromNumber:  fromNumber,
+			Content:     rendered.SMS,
+		})
+		result["sms_sent_to"] = phone
+	}
+	return e.JSON(200, result)
+}
@@ -0,0 +1,443 @@
+package lib
+
+import (
+	"fmt"
+	"html"
+	"maps"
+	"slices"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+	_ "time/tzdata" // member time zones must resolve without system tzdata
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Templates are Go text/templates. The Brevo style {{params.name}} is accepted
+// everywhere and rewritten to {{.name}} before parsing, so existing email
+// templates keep working. Layouts and partials live in the template_partials
+// collection (name, kind "layout" or "partial", html); a layout places the
+// message with {{template "content" .}} and partials are included with
+// {{template "name" .}}.
+//
+// text/template is used instead of html/template because params such as
+// is_auto_pay carry HTML, and bodies are written by staff. Use {{escape .x}}
+// for values that come from members.
+
+// smsMaxLength is the longest SMS body OpenPhone accepts.
+const smsMaxLength = 1600
+
+// KnownTemplateVariables are the variables the send paths provide. Templates
+// may use others only if they list them in their variables field.
+var KnownTemplateVariables = []string{
+	// every recipient
+	"name", "email", "first_name", "last_name", "unsubscribe_url",
+	// scheduled meeting jobs
+	"join_url", "start_url", "topic", "start_time", "start_time_est", "link_expires_at", "duration", "from_number",
+	// invoice reminders
+	"ID", "Name", "Email", "InvoiceName", "Description", "Amount", "DueDate", "LateFee", "is_auto_pay",
+}
+
+// MessageTemplate is the source of an email or SMS.
+type MessageTemplate struct {
+	Subject string
+	Body    string
+	Layout  string
+	// Variables are extra variables the template may use, e.g. job params.
+	Variables []string
+}
+
+// MessageTemplateFromRecord reads an email_template or email_basic record.
+func MessageTemplateFromRecord(r *core.Record) MessageTemplate {
+	tpl := MessageTemplate{
+		Subject: r.GetString("subject"),
+		Body:    r.GetString("html"),
+		Layout:  r.GetString("layout"),
+	}
+	r.UnmarshalJSONField("variables", &tpl.Variables)
+	return tpl
+}
+
+// RenderedTemplate is a template rendered for one recipient.
+type RenderedTemplate struct {
+	Subject string
+	HTML    string
+	Text    string
+	SMS     string
+}
+
+// TemplateEngine renders message templates with shared layouts and partials.
+type TemplateEngine struct {
+	layouts  map[string]string
+	partials map[string]string
+}
+
+// NewTemplateEngine creates an engine with the given layouts and partials.
+func NewTemplateEngine(layouts, partials map[string]string) *TemplateEngine {
+	return &TemplateEngine{layouts: layouts, partials: partials}
+}
+
+// LoadTemplateEngine creates an engine with the layouts and partials stored in
+// template_partials. If they can't be loaded the engine has none.
+func LoadTemplateEngine(app core.App) *TemplateEngine {
+	engine := NewTemplateEngine(map[string]string{}, map[string]string{})
+	records, err := app.FindAllRecords("template_partials")
+	if err != nil {
+		fmt.Printf("Failed to load template partials: %v\n", err)
+		return engine
+	}
+	for _, r := range records {
+		if r.GetString("kind") == "layout" {
+			engine.layouts[r.GetString("name")] = r.GetString("html")
+		} else {
+			engine.partials[r.GetString("name")] = r.GetString("html")
+		}
+	}
+	return engine
+}
+
+// Render renders tpl for one recipient. Dates are shown in loc, which
+// defaults to Eastern time.
+func (t *TemplateEngine) Render(tpl MessageTemplate, data map[string]any, loc *time.Location) (RenderedTemplate, error) {
+	var rendered RenderedTemplate
+	funcs := templateFuncs(loc)
+
+	subject, err := t.parse("subject", tpl.Subject, "", funcs)
+	if err != nil {
+		return rendered, fmt.Errorf("subject: %w", err)
+	}
+	if rendered.Subject, err = execute(subject, data); err != nil {
+		return rendered, fmt.Errorf("subject: %w", err)
+	}
+
+	body, err := t.parse("body", tpl.Body, "", funcs)
+	if err != nil {
+		return rendered, fmt.Errorf("body: %w", err)
+	}
+	content, err := execute(body, data)
+	if err != nil {
+		return rendered, fmt.Errorf("body: %w", err)
+	}
+	rendered.HTML = content
+	if tpl.Layout != "" {
+		page, err := t.parse("body", tpl.Body, tpl.Layout, funcs)
+		if err != nil {
+			return rendered, fmt.Errorf("layout %s: %w", tpl.Layout, err)
+		}
+		if rendered.HTML, err = execute(page, data); err != nil {
+			return rendered, fmt.Errorf("layout %s: %w", tpl.Layout, err)
+		}
+	}
+
+	rendered.Text = HTMLToText(rendered.HTML)
+	// SMS skips the layout, which is email chrome
+	rendered.SMS = HTMLToText(content)
+	if runes := []rune(rendered.SMS); len(runes) > smsMaxLength {
+		rendered.SMS = string(runes[:smsMaxLength])
+	}
+	return rendered, nil
+}
+
+// Validate parses tpl and reports variables it uses that the send paths don't
+// provide.
+func (t *TemplateEngine) Validate(tpl MessageTemplate) (unknown []string, err error) {
+	funcs := templateFuncs(nil)
+	var trees []*template.Template
+	subject, err := t.parse("subject", tpl.Subject, "", funcs)
+	if err != nil {
+		return nil, fmt.Errorf("subject: %w", err)
+	}
+	body, err := t.parse("body", tpl.Body, tpl.Layout, funcs)
+	if err != nil {
+		return nil, fmt.Errorf("body: %w", err)
+	}
+	trees = append(trees, subject, body)
+
+	used := map[string]bool{}
+	for _, tmpl := range trees {
+		for _, associated := range tmpl.Templates() {
+			if associated.Tree != nil {
+				collectFields(associated.Tree.Root, used)
+			}
+		}
+	}
+	for name := range used {
+		if !slices.Contains(KnownTemplateVariables, name) && !slices.Contains(tpl.Variables, name) {
+			unknown = append(unknown, name)
+		}
+	}
+	slices.Sort(unknown)
+	return unknown, nil
+}
+
+// parse builds the named template with all partials. With a layout, the
+// layout becomes the root and the text is defined as "content".
+func (t *TemplateEngine) parse(name, text, layout string, funcs template.FuncMap) (*template.Template, error) {
+	root := template.New(name).Funcs(funcs).Option("missingkey=zero")
+	for partial, src := range t.partials {
+		if _, err := root.New(partial).Parse(normalizeTemplate(src)); err != nil {
+			return nil, fmt.Errorf("partial %s: %w", partial, err)
+		}
+	}
+	if layout == "" {
+		return root.Parse(normalizeTemplate(text))
+	}
+	src, ok := t.layouts[layout]
+	if !ok {
+		return nil, fmt.Errorf("unknown layout %q", layout)
+	}
+	if _, err := root.New("content").Parse(normalizeTemplate(text)); err != nil {
+		return nil, err
+	}
+	return root.Parse(normalizeTemplate(src))
+}
+
+func normalizeTemplate(text string) string {
+	return brevoParamPattern.ReplaceAllString(text, "{{.$1}}")
+}
+
+func execute(tmpl *template.Template, data map[string]any) (string, error) {
+	// missing optional variables are empty strings, as a nil in a map[string]any
+	// would print "<no value>" even with missingkey=zero
+	used := map[string]bool{}
+	for _, associated := range tmpl.Templates() {
+		if associated.Tree != nil {
+			collectFields(associated.Tree.Root, used)
+		}
+	}
+	complete := maps.Clone(data)
+	if complete == nil {
+		complete = map[string]any{}
+	}
+	for name := range used {
+		if _, ok := complete[name]; !ok {
+			complete[name] = ""
+		}
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, complete); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func collectFields(node parse.Node, used map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			collectFields(c, used)
+		}
+	case *parse.ActionNode:
+		collectFields(n.Pipe, used)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			collectFields(c, used)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			collectFields(arg, used)
+		}
+	case *parse.FieldNode:
+		used[n.Ident[0]] = true
+	case *parse.ChainNode:
+		collectFields(n.Node, used)
+	case *parse.IfNode:
+		collectFields(n.Pipe, used)
+		collectFields(n.List, used)
+		collectFields(n.ElseList, used)
+	case *parse.RangeNode:
+		collectFields(n.Pipe, used)
+		collectFields(n.List, used)
+		collectFields(n.ElseList, used)
+	case *parse.WithNode:
+		collectFields(n.Pipe, used)
+		collectFields(n.List, used)
+		collectFields(n.ElseList, used)
+	case *parse.TemplateNode:
+		collectFields(n.Pipe, used)
+	}
+}
+
+// templateFuncs are the helpers available to every template.
+func templateFuncs(loc *time.Location) template.FuncMap {
+	return template.FuncMap{
+		"date": func(v any, layout ...string) string {
+			return formatTemplateTime(v, loc, firstNonEmpty(append(layout, "Jan 2, 2006")...))
+		},
+		"datetime": func(v any) string {
+			return formatTemplateTime(v, loc, "Jan 2, 2006 3:04 PM MST")
+		},
+		"currency": formatCurrency,
+		"escape":   func(v any) string { return html.EscapeString(fmt.Sprint(v)) },
+		// raw is kept for SMS templates written for the PocketBase registry
+		"raw":   func(v any) string { return fmt.Sprint(v) },
+		"upper": func(v any) string { return strings.ToUpper(fmt.Sprint(v)) },
+		"lower": func(v any) string { return strings.ToLower(fmt.Sprint(v)) },
+		"default": func(def, v any) any {
+			if v == nil || fmt.Sprint(v) == "" {
+				return def
+			}
+			return v
+		},
+	}
+}
+
+func formatTemplateTime(v any, loc *time.Location, layout string) string {
+	var t time.Time
+	switch value := v.(type) {
+	case time.Time:
+		t = value
+	case types.DateTime:
+		t = value.Time()
+	case string:
+		parsed, err := types.ParseDateTime(value)
+		if err != nil || parsed.IsZero() {
+			return value
+		}
+		t = parsed.Time()
+	default:
+		return fmt.Sprint(v)
+	}
+	if t.IsZero() {
+		return ""
+	}
+	if loc == nil {
+		loc = easternLocation()
+	}
+	return t.In(loc).Format(layout)
+}
+
+// formatCurrency formats a dollar amount as $1,234.56.
+func formatCurrency(v any) string {
+	var amount float64
+	switch value := v.(type) {
+	case float64:
+		amount = value
+	case float32:
+		amount = float64(value)
+	case int:
+		amount = float64(value)
+	case int64:
+		amount = float64(value)
+	case string:
+		if _, err := fmt.Sscanf(value, "%g", &amount); err != nil {
+			return value
+		}
+	default:
+		return fmt.Sprint(v)
+	}
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	s := fmt.Sprintf("%.2f", amount)
+	whole, cents, _ := strings.Cut(s, ".")
+	var b strings.Builder
+	for i, c := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(c)
+	}
+	return sign + "$" + b.String() + "." + cents
+}
+
+func easternLocation() *time.Location {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// memberLocation is the member's time zone (the timezone field), defaulting to
+// Eastern time.
+func memberLocation(member *core.Record) *time.Location {
+	if member == nil || member.GetString("timezone") == "" {
+		return easternLocation()
+	}
+	if loc, err := time.LoadLocation(member.GetString("timezone")); err == nil {
+		return loc
+	}
+	return easternLocation()
+}
+
+// recipientTemplateData is the data every template gets for a recipient. The
+// unsubscribe_url is left as a Brevo param for the send path to fill in.
+func recipientTemplateData(params map[string]any, member *core.Record) map[string]any {
+	data := map[string]any{"unsubscribe_url": "{{params.unsubscribe_url}}"}
+	if member != nil {
+		data["first_name"] = member.GetString("first_name")
+		data["last_name"] = member.GetString("last_name")
+		data["name"] = strings.TrimSpace(member.GetString("first_name") + " " + member.GetString("last_name"))
+		data["email"] = member.GetString("email")
+	}
+	maps.Copy(data, params)
+	return data
+}
+
+// RegisterTemplateValidation rejects email templates and partials that don't
+// parse or that use variables no send path provides.
+func RegisterTemplateValidation(app core.App) {
+	app.OnRecordValidate("email_template", "email_basic", "template_partials").BindFunc(func(e *core.RecordEvent) error {
+		engine := LoadTemplateEngine(e.App)
+		var tpl MessageTemplate
+		if e.Record.Collection().Name == "template_partials" {
+			// check the partial as it will be saved
+			if e.Record.GetString("kind") == "layout" {
+				engine.layouts[e.Record.GetString("name")] = e.Record.GetString("html")
+				tpl = MessageTemplate{Layout: e.Record.GetString("name")}
+			} else {
+				engine.partials[e.Record.GetString("name")] = e.Record.GetString("html")
+				tpl = MessageTemplate{Body: e.Record.GetString("html")}
+			}
+			tpl.Variables = templateVariablesInUse(e.App)
+		} else {
+			tpl = MessageTemplateFromRecord(e.Record)
+		}
+		unknown, err := engine.Validate(tpl)
+		if err != nil {
+			return validation.Errors{"html": validation.NewError("validation_invalid_template", err.Error())}
+		}
+		if len(unknown) > 0 {
+			return validation.Errors{"html": validation.NewError(
+				"validation_unknown_template_variables",
+				"Unknown template variables: "+strings.Join(unknown, ", ")+". Add them to variables if the job provides them.",
+			)}
+		}
+		return e.Next()
+	})
+}
+
+// templateVariablesInUse are the extra variables declared by any template, which
+// shared partials and layouts may also use.
+func templateVariablesInUse(app core.App) []string {
+	var variables []string
+	for _, collection := range []string{"email_template", "email_basic"} {
+		records, err := app.FindRecordsByFilter(collection, "variables != '[]' && variables != ''", "", 0, 0, dbx.Params{})
+		if err != nil {
+			continue
+		}
+		for _, r := range records {
+			var vars []string
+			r.UnmarshalJSONField("variables", &vars)
+			for _, v := range vars {
+				if !slices.Contains(variables, v) {
+					variables = append(variables, v)
+				}
+			}
+		}
+	}
+	return variables
+}
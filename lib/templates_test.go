@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTemplateEngineRender(t *testing.T) {
+	engine := NewTemplateEngine(
+		map[string]string{"main": `<html><body>{{template "content" .}}{{template "footer" .}}</body></html>`},
+		map[string]string{"footer": `<p>Questions? Reply to this email.</p>`},
+	)
+	tpl := MessageTemplate{
+		Subject: "Invoice for {{params.first_name}}",
+		Body:    `<p>Hi {{params.first_name}}, {{currency .Amount}} is due {{date .DueDate}}.</p>{{params.is_auto_pay}}`,
+		Layout:  "main",
+	}
+	loc, _ := time.LoadLocation("America/Los_Angeles")
+	rendered, err := engine.Render(tpl, map[string]any{
+		"first_name": "Ada",
+		"Amount":     1234.5,
+		"DueDate":    "2026-03-01 03:00:00.000Z",
+	}, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rendered.Subject != "Invoice for Ada" {
+		t.Errorf("subject = %q", rendered.Subject)
+	}
+	want := "<html><body><p>Hi Ada, $1,234.50 is due Feb 28, 2026.</p><p>Questions? Reply to this email.</p></body></html>"
+	if rendered.HTML != want {
+		t.Errorf("html = %q, want %q", rendered.HTML, want)
+	}
+	if !strings.Contains(rendered.Text, "Hi Ada, $1,234.50 is due Feb 28, 2026.") {
+		t.Errorf("text = %q", rendered.Text)
+	}
+	if strings.Contains(rendered.SMS, "Questions?") {
+		t.Errorf("sms should not include the layout: %q", rendered.SMS)
+	}
+}
+
+func TestTemplateEngineValidate(t *testing.T) {
+	engine := NewTemplateEngine(nil, map[string]string{"sig": "{{.signature}}"})
+	unknown, err := engine.Validate(MessageTemplate{
+		Subject:   "{{params.topic}}",
+		Body:      `{{if .start_url}}{{params.start_url}}{{end}} {{params.room}} {{params.host}} {{template "sig" .}}`,
+		Variables: []string{"host"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(unknown, ",") != "room,signature" {
+		t.Errorf("unknown = %v", unknown)
+	}
+
+	if _, err := engine.Validate(MessageTemplate{Body: "{{if .x}}"}); err == nil {
+		t.Error("expected a parse error")
+	}
+}
+
+func TestFormatCurrency(t *testing.T) {
+	for in, want := range map[float64]string{0: "$0.00", 12.3: "$12.30", 1000: "$1,000.00", -2500000.5: "-$2,500,000.50"} {
+		if got := formatCurrency(in); got != want {
+			t.Errorf("formatCurrency(%v) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSMSSegments(t *testing.T) {
+	tests := []struct {
+		text     string
+		segments int
+		encoding string
+	}{
+		{"", 0, "GSM-7"},
+		{strings.Repeat("a", 160), 1, "GSM-7"},
+		{strings.Repeat("a", 161), 2, "GSM-7"},
+		{strings.Repeat("{", 80), 1, "GSM-7"},
+		{strings.Repeat("{", 81), 2, "GSM-7"},
+		{"See you soon 🙂", 1, "UCS-2"},
+		{strings.Repeat("é", 70) + "✓", 2, "UCS-2"},
+	}
+	for _, tt := range tests {
+		segments, encoding := SMSSegments(tt.text)
+		if segments != tt.segments || encoding != tt.encoding {
+			t.Errorf("SMSSegments(%.20q) = %d %s, want %d %s", tt.text, segments, encoding, tt.segments, tt.encoding)
+		}
+	}
+}
+
+func TestTemplateEngineRenderMissingAndHelpers(t *testing.T) {
+	engine := NewTemplateEngine(nil, nil)
+	tpl := MessageTemplate{Body: `{{if .first_name}}Hi {{upper .first_name}}{{else}}Hi there{{end}}, {{default "soon" .start_time}}.{{.missing}}`}
+	for _, tt := range []struct {
+		data map[string]any
+		want string
+	}{
+		{map[string]any{"first_name": "Ada"}, "Hi ADA, soon."},
+		{map[string]any{"first_name": ""}, "Hi there, soon."},
+		{nil, "Hi there, soon."},
+	} {
+		rendered, err := engine.Render(tpl, tt.data, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rendered.HTML != tt.want {
+			t.Errorf("data %v: html = %q, want %q", tt.data, rendered.HTML, tt.want)
+		}
+	}
+}
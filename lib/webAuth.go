@@ -5,8 +5,8 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-
 	"slices"
+	"time"
 
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/pocketbase/dbx"
@@ -32,6 +32,11 @@ const (
 type CredentialPB struct {
 	DeviceName string `json:"device_name"`
 	DeviceID   string `json:"device_id"`
+	Created    string `json:"created,omitempty"`
+	LastUsed   string `json:"last_used,omitempty"`
+	// AttestationVerified is set when the attestation was verified against
+	// the FIDO metadata at registration.
+	AttestationVerified bool `json:"attestation_verified,omitempty"`
 }
 
 // Define a new type
@@ -178,7 +183,7 @@ func (user User) SendAuthTokenResponse(collection string, app *pocketbase.Pocket
 	return apis.RecordAuthResponse(e, authRecord, "passkey", nil)
 }
 
-func (user *User) AddWebAuthnCredential(app *pocketbase.PocketBase, collection string, newCredential webauthn.Credential, device_name string) error {
+func (user *User) AddWebAuthnCredential(app *pocketbase.PocketBase, collection string, newCredential webauthn.Credential, device_name string, attestationVerified bool) error {
 	// Use the shared decoding logic to get the current credentials,
 	// which handles both direct and double-encoded JSON.
 	credentials := user.WebAuthnCredentials() // returns []webauthn.Credential
@@ -192,8 +197,10 @@ func (user *User) AddWebAuthnCredential(app *pocketbase.PocketBase, collection s
 		user.CredentialsListPB = &emptyList
 	}
 	updatedList := append(*user.CredentialsListPB, CredentialPB{
-		DeviceName: device_name,
-		DeviceID:   IDString(newCredential),
+		DeviceName:          device_name,
+		DeviceID:            IDString(newCredential),
+		Created:             time.Now().UTC().Format(time.RFC3339),
+		AttestationVerified: attestationVerified,
 	})
 	user.CredentialsListPB = &updatedList
 
@@ -271,3 +278,74 @@ func (user User) DeleteWebAuthnCredential(app *pocketbase.PocketBase, collection
 func IDString(c webauthn.Credential) string {
 	return base64.RawURLEncoding.EncodeToString(c.ID)
 }
+
+// UpdateWebAuthnCredential stores the credential returned by a login, which
+// carries the new sign count and flags, and records when it was last used.
+func (user *User) UpdateWebAuthnCredential(app *pocketbase.PocketBase, collection string, updated webauthn.Credential) error {
+	credentials := user.WebAuthnCredentials()
+	found := false
+	for i, c := range credentials {
+		if IDString(c) == IDString(updated) {
+			credentials[i] = updated
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("credential %s not found", IDString(updated))
+	}
+	list := user.credentialsList()
+	now := time.Now().UTC().Format(time.RFC3339)
+	i := slices.IndexFunc(list, func(c CredentialPB) bool { return c.DeviceID == IDString(updated) })
+	if i < 0 {
+		list = append(list, CredentialPB{DeviceName: "unknown", DeviceID: IDString(updated)})
+		i = len(list) - 1
+	}
+	list[i].LastUsed = now
+	return user.saveWebAuthnCredentials(app, collection, credentials, list)
+}
+
+// RenameWebAuthnCredential changes the display name of a passkey.
+func (user *User) RenameWebAuthnCredential(app *pocketbase.PocketBase, collection string, credentialID string, name string) error {
+	credentials := user.WebAuthnCredentials()
+	if !slices.ContainsFunc(credentials, func(c webauthn.Credential) bool { return IDString(c) == credentialID }) {
+		return fmt.Errorf("credential %s not found", credentialID)
+	}
+	list := user.credentialsList()
+	i := slices.IndexFunc(list, func(c CredentialPB) bool { return c.DeviceID == credentialID })
+	if i < 0 {
+		list = append(list, CredentialPB{DeviceID: credentialID})
+		i = len(list) - 1
+	}
+	list[i].DeviceName = name
+	return user.saveWebAuthnCredentials(app, collection, credentials, list)
+}
+
+func (user User) credentialsList() CredentialPBList {
+	if user.CredentialsListPB == nil {
+		return CredentialPBList{}
+	}
+	return slices.Clone(*user.CredentialsListPB)
+}
+
+func (user *User) saveWebAuthnCredentials(app *pocketbase.PocketBase, collection string, credentials []webauthn.Credential, list CredentialPBList) error {
+	credentialsJSON, err := json.Marshal(credentials)
+	if err != nil {
+		return fmt.Errorf("failed to marshal credentials: %w", err)
+	}
+	credentialsListJSON, err := json.Marshal(list)
+	if err != nil {
+		return fmt.Errorf("failed to marshal credentials list: %w", err)
+	}
+	credentialsStr := string(credentialsJSON)
+	user.WebAuthnCredentialsJSON = &credentialsStr
+	user.CredentialsListPB = &list
+
+	authRecord, err := app.FindFirstRecordByData(collection, "email", user.Username)
+	if err != nil {
+		return apis.NewNotFoundError("User not found.", err)
+	}
+	authRecord.Set(WEBAUTHN_CREDENTIALS_FIELDNAME, user.WebAuthnCredentialsJSON)
+	authRecord.Set("credentials_list", string(credentialsListJSON))
+	return app.Save(authRecord)
+}
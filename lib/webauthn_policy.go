@@ -0,0 +1,291 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/metadata/providers/cached"
+	"github.com/go-webauthn/webauthn/metadata/providers/memory"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// WebAuthnMetadata is the FIDO metadata service attestation is checked
+// against. It is empty until LoadWebAuthnMetadata succeeds; until then no new
+// passkey passes an AAGUID allowlist.
+var WebAuthnMetadata = &webAuthnMetadata{}
+
+// webAuthnMetadata is a metadata.Provider that can be loaded after the
+// webauthn config is built. Empty, it skips every metadata check like a
+// config without MDS.
+type webAuthnMetadata struct {
+	provider atomic.Pointer[metadata.Provider]
+}
+
+func (m *webAuthnMetadata) loaded() metadata.Provider {
+	if p := m.provider.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+func (m *webAuthnMetadata) GetEntry(ctx context.Context, aaguid uuid.UUID) (*metadata.Entry, error) {
+	if p := m.loaded(); p != nil {
+		return p.GetEntry(ctx, aaguid)
+	}
+	return nil, nil
+}
+
+func (m *webAuthnMetadata) GetValidateEntry(ctx context.Context) bool {
+	p := m.loaded()
+	return p != nil && p.GetValidateEntry(ctx)
+}
+
+func (m *webAuthnMetadata) GetValidateEntryPermitZeroAAGUID(ctx context.Context) bool {
+	p := m.loaded()
+	return p != nil && p.GetValidateEntryPermitZeroAAGUID(ctx)
+}
+
+func (m *webAuthnMetadata) GetValidateTrustAnchor(ctx context.Context) bool {
+	p := m.loaded()
+	return p != nil && p.GetValidateTrustAnchor(ctx)
+}
+
+func (m *webAuthnMetadata) GetValidateStatus(ctx context.Context) bool {
+	p := m.loaded()
+	return p != nil && p.GetValidateStatus(ctx)
+}
+
+func (m *webAuthnMetadata) GetValidateAttestationTypes(ctx context.Context) bool {
+	p := m.loaded()
+	return p != nil && p.GetValidateAttestationTypes(ctx)
+}
+
+func (m *webAuthnMetadata) ValidateStatusReports(ctx context.Context, reports []metadata.StatusReport) error {
+	if p := m.loaded(); p != nil {
+		return p.ValidateStatusReports(ctx, reports)
+	}
+	return nil
+}
+
+// mdsRetryDelay is the first wait before loading the FIDO metadata again,
+// doubled after each failure up to mdsMaxRetryDelay.
+var (
+	mdsRetryDelay    = time.Minute
+	mdsMaxRetryDelay = time.Hour
+)
+
+// LoadWebAuthnMetadata loads the FIDO metadata into WebAuthnMetadata. If the
+// download fails it logs an error and keeps retrying in the background until
+// it succeeds or ctx is done, so an outage at startup doesn't leave AAGUID
+// allowlists refusing new passkeys until the next restart.
+func LoadWebAuthnMetadata(ctx context.Context, app core.App) {
+	load := func() bool {
+		mds, err := NewWebAuthnMetadata()
+		if err != nil {
+			app.Logger().Error("Failed to load FIDO metadata, passkey AAGUID allowlists refuse new passkeys until it loads", "error", err)
+			return false
+		}
+		WebAuthnMetadata.provider.Store(&mds)
+		return true
+	}
+	if load() {
+		return
+	}
+	go func() {
+		delay := mdsRetryDelay
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if load() {
+				app.Logger().Info("Loaded FIDO metadata")
+				return
+			}
+			delay = min(delay*2, mdsMaxRetryDelay)
+		}
+	}()
+}
+
+// attestedFormats are the attestation formats that sign the AAGUID with a
+// certificate chain (basic or AttCA attestation). "none" and self attestation
+// carry no proof of the authenticator model.
+var attestedFormats = []string{"packed", "tpm", "android-key", "apple", "fido-u2f"}
+
+// NewWebAuthnMetadata loads the FIDO MDS3 blob, cached in WEBAUTHN_MDS_PATH
+// (default pb_data/fido_mds.jwt). Attestation certificates must chain to the
+// metadata's trust anchors and revoked authenticators are refused.
+// Authenticators missing from the metadata can still register where no
+// allowlist applies.
+func NewWebAuthnMetadata() (metadata.Provider, error) {
+	return cached.New(
+		cached.WithPath(firstNonEmpty(os.Getenv("WEBAUTHN_MDS_PATH"), "pb_data/fido_mds.jwt")),
+		cached.WithNew(func(mds *metadata.Metadata) (metadata.Provider, error) {
+			return memory.New(
+				memory.WithMetadata(mds.ToMap()),
+				memory.WithValidateEntry(false),
+				memory.WithValidateEntryPermitZeroAAGUID(true),
+				memory.WithValidateTrustAnchor(true),
+				memory.WithValidateAttestationTypes(true),
+				memory.WithValidateStatus(true),
+			)
+		}),
+	)
+}
+
+// WebAuthnPolicy is the passkey policy of one auth collection. Policies are
+// read from the webauthn_policies collection (collection, user_verification,
+// attestation, authenticator_attachment, resident_key, allowed_aaguids);
+// collections without a row use defaultWebAuthnPolicy.
+type WebAuthnPolicy struct {
+	Collection              string
+	UserVerification        protocol.UserVerificationRequirement
+	Attestation             protocol.ConveyancePreference
+	AuthenticatorAttachment protocol.AuthenticatorAttachment
+	ResidentKey             protocol.ResidentKeyRequirement
+	// AllowedAAGUIDs limits passkeys to these authenticator models. Empty
+	// allows any authenticator.
+	AllowedAAGUIDs []string
+}
+
+// defaultWebAuthnPolicy requires user verification for staff and lets members
+// use any passkey.
+func defaultWebAuthnPolicy(collection string) WebAuthnPolicy {
+	policy := WebAuthnPolicy{
+		Collection:       collection,
+		UserVerification: protocol.VerificationPreferred,
+		Attestation:      protocol.PreferNoAttestation,
+		ResidentKey:      protocol.ResidentKeyRequirementPreferred,
+	}
+	if collection == "users" {
+		policy.UserVerification = protocol.VerificationRequired
+	}
+	return policy
+}
+
+// LoadWebAuthnPolicy returns the policy for collection, falling back to the
+// defaults for fields left empty.
+func LoadWebAuthnPolicy(app core.App, collection string) WebAuthnPolicy {
+	policy := defaultWebAuthnPolicy(collection)
+	record, err := app.FindFirstRecordByData("webauthn_policies", "collection", collection)
+	if err != nil {
+		return policy
+	}
+	if v := record.GetString("user_verification"); v != "" {
+		policy.UserVerification = protocol.UserVerificationRequirement(v)
+	}
+	if v := record.GetString("attestation"); v != "" {
+		policy.Attestation = protocol.ConveyancePreference(v)
+	}
+	if v := record.GetString("authenticator_attachment"); v != "" {
+		policy.AuthenticatorAttachment = protocol.AuthenticatorAttachment(v)
+	}
+	if v := record.GetString("resident_key"); v != "" {
+		policy.ResidentKey = protocol.ResidentKeyRequirement(v)
+	}
+	var aaguids []string
+	if err := record.UnmarshalJSONField("allowed_aaguids", &aaguids); err == nil {
+		for _, a := range aaguids {
+			policy.AllowedAAGUIDs = append(policy.AllowedAAGUIDs, strings.ToLower(strings.TrimSpace(a)))
+		}
+	}
+	// an allowlist is checked against the attestation statement, which is
+	// only sent when asked for; see verifiedAttestation
+	if len(policy.AllowedAAGUIDs) > 0 && policy.Attestation == protocol.PreferNoAttestation {
+		policy.Attestation = protocol.PreferDirectAttestation
+	}
+	return policy
+}
+
+// RegistrationOptions are the BeginRegistration options for the policy.
+func (p WebAuthnPolicy) RegistrationOptions() []webauthn.RegistrationOption {
+	return []webauthn.RegistrationOption{
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			AuthenticatorAttachment: p.AuthenticatorAttachment,
+			UserVerification:        p.UserVerification,
+		}),
+		// after the selection, which would otherwise reset it
+		webauthn.WithResidentKeyRequirement(p.ResidentKey),
+		webauthn.WithConveyancePreference(p.Attestation),
+	}
+}
+
+// LoginOptions are the BeginLogin options for the policy.
+func (p WebAuthnPolicy) LoginOptions() []webauthn.LoginOption {
+	return []webauthn.LoginOption{webauthn.WithUserVerification(p.UserVerification)}
+}
+
+// CheckCredential rejects a new credential the policy doesn't allow.
+func (p WebAuthnPolicy) CheckCredential(credential *webauthn.Credential) error {
+	return p.CheckLogin(credential, false)
+}
+
+// VerifiesAttestation reports whether CheckCredential verified the
+// attestation of the credentials it let through.
+func (p WebAuthnPolicy) VerifiesAttestation() bool {
+	return len(p.AllowedAAGUIDs) > 0
+}
+
+// CheckLogin rejects a used credential the policy doesn't allow, so tightening
+// a policy also locks out passkeys that were registered before. The
+// attestation is only checked again for credentials whose attestation wasn't
+// verified at registration; the stored attestation can't change, and logins
+// shouldn't depend on the FIDO metadata being loaded.
+func (p WebAuthnPolicy) CheckLogin(credential *webauthn.Credential, attestationVerified bool) error {
+	if p.UserVerification == protocol.VerificationRequired && !credential.Flags.UserVerified {
+		return fmt.Errorf("%s passkeys must verify the user with a PIN or biometrics", p.Collection)
+	}
+	if len(p.AllowedAAGUIDs) > 0 {
+		aaguid := formatAAGUID(credential.Authenticator.AAGUID)
+		if !slices.Contains(p.AllowedAAGUIDs, aaguid) {
+			return fmt.Errorf("%s is not an allowed authenticator for %s", authenticatorName(aaguid), p.Collection)
+		}
+		if attestationVerified {
+			return nil
+		}
+		if err := verifiedAttestation(credential); err != nil {
+			return fmt.Errorf("%s passkeys must prove their authenticator model: %w", p.Collection, err)
+		}
+	}
+	return nil
+}
+
+// verifiedAttestation checks that the credential's AAGUID was signed by a
+// certificate chaining to the FIDO metadata, since an authenticator can claim
+// any AAGUID otherwise.
+func verifiedAttestation(credential *webauthn.Credential) error {
+	if !slices.Contains(attestedFormats, credential.AttestationType) {
+		return fmt.Errorf("attestation %q doesn't identify the authenticator", credential.AttestationType)
+	}
+	var attestation protocol.AttestationObject
+	if err := webauthncbor.Unmarshal(credential.Attestation.Object, &attestation); err != nil {
+		return fmt.Errorf("invalid attestation: %w", err)
+	}
+	if x5c, _ := attestation.AttStatement["x5c"].([]any); len(x5c) == 0 {
+		return fmt.Errorf("self attestation doesn't identify the authenticator")
+	}
+	mds := WebAuthnMetadata.loaded()
+	if mds == nil {
+		return fmt.Errorf("no FIDO metadata is loaded")
+	}
+	aaguid, err := uuid.FromBytes(credential.Authenticator.AAGUID)
+	if err != nil {
+		return fmt.Errorf("invalid AAGUID: %w", err)
+	}
+	// without an entry the trust anchors aren't checked
+	if entry, err := mds.GetEntry(context.Background(), aaguid); err != nil || entry == nil {
+		return fmt.Errorf("authenticator %s is not in the FIDO metadata", aaguid)
+	}
+	return credential.Verify(mds)
+}
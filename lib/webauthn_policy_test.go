@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+func TestWebAuthnPolicyCheckCredential(t *testing.T) {
+	yubikey := []byte{0xcb, 0x69, 0x48, 0x1e, 0x8f, 0xf7, 0x40, 0x39, 0x93, 0xec, 0x0a, 0x27, 0x29, 0xa1, 0x54, 0xa8}
+	credential := func(aaguid []byte, verified bool) *webauthn.Credential {
+		c := &webauthn.Credential{}
+		c.Authenticator.AAGUID = aaguid
+		c.Flags.UserVerified = verified
+		return c
+	}
+
+	members := defaultWebAuthnPolicy("members")
+	if err := members.CheckCredential(credential(nil, false)); err != nil {
+		t.Errorf("members: unexpected error %v", err)
+	}
+
+	staff := defaultWebAuthnPolicy("users")
+	if err := staff.CheckCredential(credential(nil, false)); err == nil {
+		t.Error("users: expected an error without user verification")
+	}
+	if err := staff.CheckCredential(credential(nil, true)); err != nil {
+		t.Errorf("users: unexpected error %v", err)
+	}
+
+	staff.AllowedAAGUIDs = []string{"cb69481e-8ff7-4039-93ec-0a2729a154a8"}
+	if err := staff.CheckCredential(credential(make([]byte, 16), true)); err == nil {
+		t.Error("allowlist: expected an error for an unlisted authenticator")
+	}
+
+	// a listed AAGUID is only a claim unless the authenticator attests to it
+	unattested := credential(yubikey, true)
+	unattested.AttestationType = "none"
+	if err := staff.CheckCredential(unattested); err == nil {
+		t.Error("allowlist: expected an error for a none attestation")
+	}
+	selfAttested := credential(yubikey, true)
+	selfAttested.AttestationType = "packed"
+	selfAttested.Attestation.Object, _ = webauthncbor.Marshal(map[string]any{
+		"fmt":     "packed",
+		"attStmt": map[string]any{"alg": -7, "sig": []byte{1}},
+	})
+	if err := staff.CheckCredential(selfAttested); err == nil {
+		t.Error("allowlist: expected an error for a self attestation")
+	}
+
+	// logins don't check the attestation again once it was verified at
+	// registration, so they keep working without the FIDO metadata
+	if err := staff.CheckLogin(selfAttested, false); err == nil {
+		t.Error("login: expected an error for an attestation that wasn't verified")
+	}
+	if err := staff.CheckLogin(selfAttested, true); err != nil {
+		t.Errorf("login: unexpected error %v", err)
+	}
+	if err := staff.CheckLogin(credential(make([]byte, 16), true), true); err == nil {
+		t.Error("login: expected an error for an unlisted authenticator")
+	}
+}
+
+func TestWebAuthnMetadataEmpty(t *testing.T) {
+	m := &webAuthnMetadata{}
+	if entry, err := m.GetEntry(context.Background(), uuid.Nil); entry != nil || err != nil {
+		t.Errorf("GetEntry = %v, %v", entry, err)
+	}
+	if m.GetValidateEntry(context.Background()) || m.GetValidateTrustAnchor(context.Background()) || m.GetValidateStatus(context.Background()) {
+		t.Error("empty metadata validates")
+	}
+}
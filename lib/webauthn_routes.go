@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+// WebAuthnCollections are the auth collections passkeys can log in to, from
+// the comma separated WEBAUTHN_COLLECTIONS (default "members,users").
+func WebAuthnCollections() []string {
+	var collections []string
+	for _, c := range strings.Split(firstNonEmpty(os.Getenv("WEBAUTHN_COLLECTIONS"), "members,users"), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			collections = append(collections, c)
+		}
+	}
+	return collections
+}
+
+// FindUserByHandle resolves a WebAuthn user handle to the user and its
+// collection by looking it up in webauthn_id_b64 across WebAuthnCollections.
+func FindUserByHandle(app *pocketbase.PocketBase, userHandle []byte) (*User, string, error) {
+	idB64 := base64.StdEncoding.EncodeToString(userHandle)
+	for _, collection := range WebAuthnCollections() {
+		record, err := app.FindFirstRecordByData(collection, WEBAUTHN_ID_B64_FIELDNAME, idB64)
+		if err != nil {
+			continue
+		}
+		user, err := FindUser(app, record.GetString("email"), collection)
+		if err != nil {
+			return nil, "", err
+		}
+		return user, collection, nil
+	}
+	return nil, "", fmt.Errorf("no user with this passkey")
+}
+
+// RegisterWebAuthnRoutes registers the discoverable (usernameless) login and
+// the routes members and staff use to manage their own passkeys.
+func RegisterWebAuthnRoutes(sr *router.Router[*core.RequestEvent], app *pocketbase.PocketBase, webAuthn *webauthn.WebAuthn, sessions WebAuthnSessionStore) {
+	// ?mediation=conditional starts a login for passkey autofill
+	sr.POST("/webauth/login/discoverable", func(e *core.RequestEvent) error {
+		mediation := protocol.CredentialMediationRequirement(e.Request.URL.Query().Get("mediation"))
+		options, sessionData, err := webAuthn.BeginDiscoverableMediatedLogin(mediation)
+		if err != nil {
+			return apis.NewBadRequestError("Failed to start login flow.", err)
+		}
+		ceremonyID, err := sessions.Save(CeremonyLogin, sessionData)
+		if err != nil {
+			return apis.NewInternalServerError("Failed to store session data.", err)
+		}
+		return CeremonyResponse(e, ceremonyID, options)
+	})
+
+	sr.POST("/webauth/login/discoverable/finish", func(e *core.RequestEvent) error {
+		sessionData, err := sessions.Consume(CeremonyLogin, CeremonyID(e))
+		if err != nil {
+			return apis.NewBadRequestError("Invalid session data.", err)
+		}
+		io.ReadAll(e.Request.Body)
+		var collection string
+		found, credential, err := webAuthn.FinishPasskeyLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			user, c, err := FindUserByHandle(app, userHandle)
+			if err != nil {
+				return nil, err
+			}
+			collection = c
+			return user, nil
+		}, *sessionData, e.Request)
+		if err != nil {
+			RecordAuthFailure(app, e, AuthEvent{Event: "login", Method: AuthMethodPasskey, Collection: collection}, err)
+			return apis.NewBadRequestError("Failed to finish login flow.", err)
+		}
+		user := found.(*User)
+		if err := CompleteWebAuthnLogin(app, e, user, collection, credential); err != nil {
+			return err
+		}
+		return user.SendAuthTokenResponse(collection, app, e)
+	})
+
+	sr.GET("/webauthn/credentials", func(e *core.RequestEvent) error {
+		user, err := FindUser(app, e.Auth.Email(), e.Auth.Collection().Name)
+		if err != nil {
+			return apis.NewNotFoundError("User not found.", err)
+		}
+		return e.JSON(200, map[string]any{"items": user.Passkeys()})
+	}).Bind(apis.RequireAuth())
+
+	sr.PATCH("/webauthn/credentials/{credentialid}", func(e *core.RequestEvent) error {
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := e.BindBody(&body); err != nil || strings.TrimSpace(body.Name) == "" {
+			return apis.NewBadRequestError("A name is required.", err)
+		}
+		user, err := FindUser(app, e.Auth.Email(), e.Auth.Collection().Name)
+		if err != nil {
+			return apis.NewNotFoundError("User not found.", err)
+		}
+		err = user.RenameWebAuthnCredential(app, e.Auth.Collection().Name, e.Request.PathValue("credentialid"), strings.TrimSpace(body.Name))
+		if err != nil {
+			return apis.NewNotFoundError("Passkey not found.", err)
+		}
+		return e.JSON(200, map[string]any{"items": user.Passkeys()})
+	}).Bind(apis.RequireAuth())
+
+	sr.DELETE("/webauthn/credentials/{credentialid}", func(e *core.RequestEvent) error {
+		user, err := FindUser(app, e.Auth.Email(), e.Auth.Collection().Name)
+		if err != nil {
+			return apis.NewNotFoundError("User not found.", err)
+		}
+		credentialID := e.Request.PathValue("credentialid")
+		if !slices.ContainsFunc(user.Passkeys(), func(p Passkey) bool { return p.ID == credentialID }) {
+			return apis.NewNotFoundError("Passkey not found.", nil)
+		}
+		if err := user.DeleteWebAuthnCredential(app, e.Auth.Collection().Name, credentialID); err != nil {
+			return apis.NewBadRequestError("Failed to delete credential.", err)
+		}
+		user, err = FindUser(app, e.Auth.Email(), e.Auth.Collection().Name)
+		if err != nil {
+			return apis.NewNotFoundError("User not found.", err)
+		}
+		return e.JSON(200, map[string]any{"items": user.Passkeys()})
+	}).Bind(apis.RequireAuth(), RequireStepUp())
+}
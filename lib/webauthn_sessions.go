@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+// WebAuthn ceremony kinds. A session saved for one kind can't be consumed as
+// another, so a login challenge can't finish a registration.
+const (
+	CeremonyRegistration = "registration"
+	CeremonyLogin        = "login"
+)
+
+// ceremonyCookie carries the ceremony id for clients that don't echo it back.
+const ceremonyCookie = "webauthn_ceremony"
+
+// ErrSessionNotFound is returned for unknown, expired or already used ceremonies.
+var ErrSessionNotFound = errors.New("webauthn session not found or expired")
+
+// WebAuthnSessionStore keeps the session data of ceremonies in progress.
+// Sessions are keyed by a random ceremony id handed to the client, and each can
+// be consumed once.
+type WebAuthnSessionStore interface {
+	Save(kind string, data *webauthn.SessionData) (ceremonyID string, err error)
+	Consume(kind, ceremonyID string) (*webauthn.SessionData, error)
+	Cleanup() error
+}
+
+// RecordSessionStore is a WebAuthnSessionStore backed by the webauthn_sessions
+// collection (ceremony_id, kind, data, expires), so ceremonies survive
+// restarts and are shared between replicas.
+type RecordSessionStore struct {
+	App core.App
+	TTL time.Duration
+}
+
+func NewRecordSessionStore(app core.App, ttl time.Duration) *RecordSessionStore {
+	return &RecordSessionStore{App: app, TTL: ttl}
+}
+
+func (s *RecordSessionStore) Save(kind string, data *webauthn.SessionData) (string, error) {
+	collection, err := s.App.FindCollectionByNameOrId("webauthn_sessions")
+	if err != nil {
+		return "", fmt.Errorf("failed to find collection: %v", err)
+	}
+	expires := time.Now().UTC().Add(s.TTL)
+	if !data.Expires.IsZero() && data.Expires.Before(expires) {
+		expires = data.Expires.UTC()
+	}
+	ceremonyID := security.RandomString(32)
+	record := core.NewRecord(collection)
+	record.Set("ceremony_id", ceremonyID)
+	record.Set("kind", kind)
+	record.Set("data", data)
+	record.Set("expires", expires)
+	if err := s.App.Save(record); err != nil {
+		return "", fmt.Errorf("failed to save webauthn session: %v", err)
+	}
+	return ceremonyID, nil
+}
+
+// Consume returns the session and deletes it. Of two concurrent calls for the
+// same ceremony only one gets the session.
+func (s *RecordSessionStore) Consume(kind, ceremonyID string) (*webauthn.SessionData, error) {
+	if ceremonyID == "" {
+		return nil, ErrSessionNotFound
+	}
+	record, err := s.App.FindFirstRecordByData("webauthn_sessions", "ceremony_id", ceremonyID)
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+	res, err := s.App.DB().Delete("webauthn_sessions", dbx.HashExp{"id": record.Id}).Execute()
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume webauthn session: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return nil, ErrSessionNotFound
+	}
+	if record.GetString("kind") != kind || record.GetDateTime("expires").Time().Before(time.Now()) {
+		return nil, ErrSessionNotFound
+	}
+	var data webauthn.SessionData
+	if err := record.UnmarshalJSONField("data", &data); err != nil {
+		return nil, fmt.Errorf("failed to decode webauthn session: %v", err)
+	}
+	return &data, nil
+}
+
+// Cleanup deletes abandoned ceremonies.
+func (s *RecordSessionStore) Cleanup() error {
+	_, err := s.App.DB().Delete("webauthn_sessions", dbx.NewExp(
+		"expires < {:now}", dbx.Params{"now": time.Now().UTC().Format("2006-01-02 15:04:05.000Z")},
+	)).Execute()
+	return err
+}
+
+// CeremonyResponse returns the ceremony options to the client along with the
+// ceremony id, which the finish call must send back as ?ceremony= or the
+// X-Ceremony-Id header. The id is also set as a short-lived cookie for
+// clients that don't.
+func CeremonyResponse(e *core.RequestEvent, ceremonyID string, options any) error {
+	http.SetCookie(e.Response, &http.Cookie{
+		Name:     ceremonyCookie,
+		Value:    ceremonyID,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   600,
+	})
+	e.Response.Header().Set("X-Ceremony-Id", ceremonyID)
+	b, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	var body map[string]any
+	if err := json.Unmarshal(b, &body); err != nil {
+		return err
+	}
+	body["ceremony_id"] = ceremonyID
+	return e.JSON(http.StatusOK, body)
+}
+
+// CeremonyID reads the ceremony id of a finish call.
+func CeremonyID(e *core.RequestEvent) string {
+	if id := e.Request.URL.Query().Get("ceremony"); id != "" {
+		return id
+	}
+	if id := e.Request.Header.Get("X-Ceremony-Id"); id != "" {
+		return id
+	}
+	if c, err := e.Request.Cookie(ceremonyCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
@@ -17,7 +17,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/joho/godotenv"
 	"github.com/pocketbase/pocketbase"
@@ -53,22 +52,30 @@ func main() {
 		RPOrigins:     rpOrigins,            // array of origins from where the webapp is served
 	}
 
+	// attestation is checked against the FIDO metadata for AAGUID allowlists,
+	// loaded once the app is created
+	wconfig.MDS = lib.WebAuthnMetadata
+
 	webAuthn, err := webauthn.New(wconfig)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	// create a map holding the sessions used during registration and login flow
-	webAuthnSessions := make(map[string]*webauthn.SessionData)
 	stripe.Key = os.Getenv("STRIPE")
 	lib.InitDB()
 	app := pocketbase.New()
+	// sessions used during the registration and login flows, keyed by ceremony id
+	webAuthnSessions := lib.NewRecordSessionStore(app, 5*time.Minute)
 	appCtx, cancel = context.WithCancel(context.Background())
 	defer cancel()
+	lib.LoadWebAuthnMetadata(appCtx, app)
 
 	// Register email mailer to replace pocketbase mailer with lib.EmailSender
+	lib.InitEmailProvider(app)
 	email.RegisterMailer(app)
+	lib.RegisterTemplateValidation(app)
+	lib.RegisterAuthEventHooks(app)
 
 	// Initialize Zoom components before the server starts
 	zoomcon.SetStatusChannel(statusIn)
@@ -77,8 +84,17 @@ func main() {
 
 	openphone.Start(appCtx)
 
+	app.RootCmd.AddCommand(lib.NewInvoiceExportCommand(app))
+
 	app.Cron().MustAdd("check_invoice", "0 11 * * *", func() { lib.CheckInvoice(app) })
 	app.Cron().Add("schedule_check", "0,30 * * * *", func() { lib.ScheduleCheck(app) })
+	app.Cron().MustAdd("scheduled_emails", "* * * * *", func() { lib.SendDueScheduledEmails(app) })
+	app.Cron().MustAdd("email_outbox", "* * * * *", func() { lib.ProcessEmailOutbox(app) })
+	app.Cron().MustAdd("webauthn_sessions", "*/10 * * * *", func() {
+		if err := webAuthnSessions.Cleanup(); err != nil {
+			app.Logger().Error("Failed to clean up webauthn sessions", "error", err)
+		}
+	})
 	app.Cron().MustAdd("student_zoom_reg", "0 12 * * 1", func() {
 		now := time.Now()
 		if !isFourthMonday(now) {
@@ -91,40 +107,52 @@ func main() {
 	})
 	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
 		lib.RegisterStripeWebhook(se.Router, app)
+		lib.RegisterBrevoWebhook(se.Router, app)
+		lib.RegisterEmailPreferenceRoutes(se.Router)
 		authentication.RegisterOAuthRoutes(se.Router)
+		authentication.RegisterOAuthPasskeyRoutes(se.Router, app, webAuthn, webAuthnSessions)
 		zoomcon.Routes(se.Router)
+		lib.RegisterWebAuthnRoutes(se.Router, app, webAuthn, webAuthnSessions)
+		lib.RegisterAuthEventRoutes(se.Router)
+		lib.RegisterStepUpRoutes(se.Router, app, webAuthn, webAuthnSessions)
+		lib.RegisterPasskeyRecoveryRoutes(se.Router, app)
+		lib.RegisterOTPLoginRoutes(se.Router, app)
 
 		se.Router.POST("/webauth/register/{collection}/{userb64}", func(e *core.RequestEvent) error {
 			collection := e.Request.PathValue("collection")
 			usernameb64 := e.Request.PathValue("userb64")
 			email, err := base64.StdEncoding.DecodeString(usernameb64)
-			//username must be the same as the authRecord username
-			authRecord := e.Auth
-			if authRecord.GetString("email") != string(email) {
-				return apis.NewBadRequestError("Invalid username.", nil)
-			}
 			if err != nil {
 				return apis.NewBadRequestError("Invalid username.", err)
 			}
+			// the passkey can only be added to the account the token is for,
+			// RequireStepUpIfEnrolled only checked that account's passkeys
+			authRecord := e.Auth
+			if authRecord.Collection().Name != collection {
+				return apis.NewForbiddenError("You can only add a passkey to your own account.", nil)
+			}
 			user, err := lib.FindUser(app, string(email), collection)
 			if err != nil {
 				return apis.NewNotFoundError("User not found.", err)
 			}
-			// start the registration flow
-			options, sessionData, err := webAuthn.BeginRegistration(user,
-				webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
-				webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
-					UserVerification: protocol.VerificationPreferred,
-				}))
+			if user.Id != authRecord.Id {
+				return apis.NewForbiddenError("You can only add a passkey to your own account.", nil)
+			}
+			// start the registration flow with the collection's passkey policy
+			policy := lib.LoadWebAuthnPolicy(app, collection)
+			options, sessionData, err := webAuthn.BeginRegistration(user, policy.RegistrationOptions()...)
 			if err != nil {
 				return apis.NewBadRequestError("Failed to start registration flow.", err)
 			}
-			// store session data in the map
-			webAuthnSessions[user.WebAuthnIdB64] = sessionData
+			// store session data under a new ceremony id
+			ceremonyID, err := webAuthnSessions.Save(lib.CeremonyRegistration, sessionData)
+			if err != nil {
+				return apis.NewInternalServerError("Failed to store session data.", err)
+			}
 
 			// send the challenge to the client
-			return e.JSON(http.StatusOK, options)
-		}).Bind(apis.RequireAuth())
+			return lib.CeremonyResponse(e, ceremonyID, options)
+		}).Bind(lib.AllowRecoveryRegistration(), apis.RequireAuth(), lib.RequireStepUpIfEnrolled())
 
 		se.Router.POST("/webauth/register/{collection}/{userb64}/finish", func(e *core.RequestEvent) error {
 			collection := e.Request.PathValue("collection")
@@ -137,17 +165,30 @@ func main() {
 			if err != nil {
 				return apis.NewNotFoundError("User not found.", err)
 			}
-			// get the session data from the map
-			sessionData := webAuthnSessions[user.WebAuthnIdB64]
-			if sessionData == nil {
-				return apis.NewBadRequestError("Invalid session data.", nil)
+			// get the session data, it can only be used once
+			sessionData, err := webAuthnSessions.Consume(lib.CeremonyRegistration, lib.CeremonyID(e))
+			if err != nil {
+				return apis.NewBadRequestError("Invalid session data.", err)
 			}
 			io.ReadAll(e.Request.Body)
 
+			registerEvent := lib.AuthEvent{
+				Event:      "passkey_register",
+				Method:     lib.AuthMethodPasskey,
+				Collection: collection,
+				RecordID:   user.Id,
+				Email:      user.Username,
+			}
 			newCredential, err := webAuthn.FinishRegistration(user, *sessionData, e.Request)
 			if err != nil {
+				lib.RecordAuthFailure(app, e, registerEvent, err)
 				return apis.NewBadRequestError("Failed to finish registration flow.", err)
 			}
+			policy := lib.LoadWebAuthnPolicy(app, collection)
+			if err := policy.CheckCredential(newCredential); err != nil {
+				lib.RecordAuthFailure(app, e, registerEvent, err)
+				return apis.NewBadRequestError("This passkey isn't allowed for this account.", err)
+			}
 			//extract device_name from the requestbody which is json encoded
 			info, err := e.RequestInfo()
 			if err != nil {
@@ -166,12 +207,12 @@ func main() {
 			}
 
 			// add the new credential to the user's stored credentials
-			err = user.AddWebAuthnCredential(app, collection, *newCredential, device_name)
+			err = user.AddWebAuthnCredential(app, collection, *newCredential, device_name, policy.VerifiesAttestation())
 			if err != nil {
 				return apis.NewBadRequestError("Failed to store new credential.", err)
 			}
-			// remove session data from the map
-			delete(webAuthnSessions, user.WebAuthnIdB64)
+			registerEvent.Details = map[string]any{"credential_id": lib.IDString(*newCredential), "device_name": device_name}
+			lib.RecordAuthEvent(app, e, registerEvent)
 			// return success with an authentication token
 			return user.SendAuthTokenResponse(collection, app, e)
 		})
@@ -188,14 +229,17 @@ func main() {
 				return apis.NewNotFoundError("User not found.", err)
 			}
 			// start login flow
-			options, sessionData, err := webAuthn.BeginLogin(user)
+			options, sessionData, err := webAuthn.BeginLogin(user, lib.LoadWebAuthnPolicy(app, collection).LoginOptions()...)
 			if err != nil {
 				return apis.NewBadRequestError("Failed to start login flow.", err)
 			}
-			// store session data in the map
-			webAuthnSessions[user.WebAuthnIdB64] = sessionData
+			// store session data under a new ceremony id
+			ceremonyID, err := webAuthnSessions.Save(lib.CeremonyLogin, sessionData)
+			if err != nil {
+				return apis.NewInternalServerError("Failed to store session data.", err)
+			}
 			// send the challenge to the client
-			return e.JSON(http.StatusOK, options)
+			return lib.CeremonyResponse(e, ceremonyID, options)
 		})
 
 		se.Router.POST("/webauth/login/{collection}/{userb64}/finish", func(e *core.RequestEvent) error {
@@ -209,18 +253,27 @@ func main() {
 			if err != nil {
 				return apis.NewNotFoundError("User not found.", err)
 			}
-			// get the session data from the map
-			sessionData := webAuthnSessions[user.WebAuthnIdB64]
-			if sessionData == nil {
-				return apis.NewBadRequestError("Invalid session data.", nil)
+			// get the session data, it can only be used once
+			sessionData, err := webAuthnSessions.Consume(lib.CeremonyLogin, lib.CeremonyID(e))
+			if err != nil {
+				return apis.NewBadRequestError("Invalid session data.", err)
 			}
 			io.ReadAll(e.Request.Body)
-			_, err = webAuthn.FinishLogin(user, *sessionData, e.Request)
+			credential, err := webAuthn.FinishLogin(user, *sessionData, e.Request)
 			if err != nil {
+				lib.RecordAuthFailure(app, e, lib.AuthEvent{
+					Event:      "login",
+					Method:     lib.AuthMethodPasskey,
+					Collection: collection,
+					RecordID:   user.Id,
+					Email:      user.Username,
+				}, err)
 				return apis.NewBadRequestError("Failed to finish login flow.", err)
 			}
-			// remove session data from the map
-			delete(webAuthnSessions, user.WebAuthnIdB64)
+			// keep the new sign count and apply the clone policy
+			if err := lib.CompleteWebAuthnLogin(app, e, user, collection, credential); err != nil {
+				return err
+			}
 			// return success
 			return user.SendAuthTokenResponse(collection, app, e)
 		})
@@ -231,6 +284,10 @@ func main() {
 			if err != nil {
 				return apis.NewBadRequestError("Invalid username.", err)
 			}
+			// only the owner may delete their passkeys
+			if e.Auth.Collection().Name != collection || e.Auth.Email() != string(email) {
+				return apis.NewForbiddenError("You can only delete your own passkeys.", nil)
+			}
 			user, err := lib.FindUser(app, string(email), collection)
 			if err != nil {
 				return apis.NewNotFoundError("User not found.", err)
@@ -243,7 +300,7 @@ func main() {
 			}
 			// return success
 			return e.JSON(http.StatusOK, nil)
-		})
+		}).Bind(apis.RequireAuth(), lib.RequireStepUp())
 		//receive submissions from the appform
 		se.Router.POST("/appform/submission", func(e *core.RequestEvent) error {
 			return appform.ReceivedSubmissionRoute(app, e)
@@ -251,7 +308,16 @@ func main() {
 		se.Router.POST("/appform/submission/small", func(e *core.RequestEvent) error {
 			return appform.ReceivedSmallSubmissionRoute(app, e)
 		})
-		se.Router.POST("/invoice/autopay/force", lib.InvoiceAutopayForceRoute).Bind(apis.RequireAuth())
+		se.Router.POST("/invoice/autopay/force", lib.InvoiceAutopayForceRoute).Bind(apis.RequireAuth(), lib.RequireStepUp())
+		se.Router.GET("/invoice/export", lib.InvoiceExportRoute).Bind(apis.RequireAuth())
+		se.Router.GET("/finance/dashboard", lib.FinanceDashboardRoute).Bind(apis.RequireAuth())
+		se.Router.GET("/email/captured", lib.CapturedEmailsRoute).Bind(apis.RequireAuth())
+		se.Router.POST("/email/templates/{collection}/{id}/preview", lib.TemplatePreviewRoute).Bind(apis.RequireAuth())
+		se.Router.POST("/email/scheduled", lib.ScheduledEmailRoute).Bind(apis.RequireAuth())
+		se.Router.GET("/email/scheduled", lib.ScheduledEmailListRoute).Bind(apis.RequireAuth())
+		se.Router.DELETE("/email/scheduled/{id}", lib.ScheduledEmailCancelRoute).Bind(apis.RequireAuth())
+		se.Router.GET("/email/outbox", lib.EmailOutboxRoute).Bind(apis.RequireAuth())
+		se.Router.POST("/email/outbox/{id}/resend", lib.EmailOutboxResendRoute).Bind(apis.RequireAuth())
 		authentication.Routes(se.Router)
 		return se.Next()
 	})